@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/commondream/yamlast"
+)
+
+const (
+	// IfEnvTag marks a mapping that's replaced by its Then value when the
+	// active environment is one of its Environment values, and by its Else
+	// value otherwise.
+	IfEnvTag = "!if-env"
+
+	// WhenTag marks a mapping that's replaced by its Then value when its
+	// Condition is true, and by its Else value otherwise.
+	WhenTag = "!when"
+)
+
+// expandConditionals replaces the !if-env and !when children of node with
+// the branch their condition selects. Without an Else, a false condition
+// drops the child, along with its key in a mapping.
+func (template *Template) expandConditionals(node *yamlast.Node) (bool, error) {
+	expanded := false
+
+	switch node.Kind {
+	case yamlast.MappingNode:
+		for i := 0; i+1 < len(node.Children); {
+			if !isConditional(node.Children[i+1]) {
+				i += 2
+				continue
+			}
+
+			branch, err := template.evaluateConditional(node.Children[i+1])
+			if err != nil {
+				return false, err
+			}
+
+			if branch == nil {
+				node.Children = append(node.Children[:i], node.Children[i+2:]...)
+			} else {
+				node.Children[i+1] = branch
+			}
+			expanded = true
+		}
+
+	case yamlast.SequenceNode:
+		for i := 0; i < len(node.Children); {
+			if !isConditional(node.Children[i]) {
+				i++
+				continue
+			}
+
+			branch, err := template.evaluateConditional(node.Children[i])
+			if err != nil {
+				return false, err
+			}
+
+			if branch == nil {
+				node.Children = append(node.Children[:i], node.Children[i+1:]...)
+			} else {
+				node.Children[i] = branch
+			}
+			expanded = true
+		}
+	}
+
+	return expanded, nil
+}
+
+func isConditional(node *yamlast.Node) bool {
+	return node.Tag == IfEnvTag || node.Tag == WhenTag
+}
+
+// evaluateConditional returns the branch of a conditional its condition
+// selects, or nil when the node should be dropped.
+func (template *Template) evaluateConditional(conditional *yamlast.Node) (*yamlast.Node, error) {
+	conditionKey := "Condition"
+	if conditional.Tag == IfEnvTag {
+		conditionKey = "Environment"
+	}
+
+	if conditional.Kind != yamlast.MappingNode {
+		return nil, fmt.Errorf("%s needs a mapping with %s and Then", conditional.Tag, conditionKey)
+	}
+
+	condition := selectNode(conditional, conditionKey)
+	then := selectNode(conditional, "Then")
+	if condition == nil || then == nil {
+		return nil, fmt.Errorf("%s needs a mapping with %s and Then", conditional.Tag, conditionKey)
+	}
+
+	// Conditions can come from a tag like !meta or !config.
+	condition, err := template.resolveNode(condition)
+	if err != nil {
+		return nil, err
+	}
+
+	var result bool
+	if conditional.Tag == IfEnvTag {
+		result = template.matchesEnvironment(condition)
+	} else {
+		result = isTruthy(condition)
+	}
+
+	if result {
+		return then, nil
+	}
+
+	return selectNode(conditional, "Else"), nil
+}
+
+// matchesEnvironment is true when the active environment is the environment,
+// or one of the list of environments, in node.
+func (template *Template) matchesEnvironment(node *yamlast.Node) bool {
+	environment := template.Config.Environment
+	if environment == "" {
+		return false
+	}
+
+	if node.Kind == yamlast.SequenceNode {
+		for _, child := range node.Children {
+			if child.Kind == yamlast.ScalarNode && child.Value == environment {
+				return true
+			}
+		}
+		return false
+	}
+
+	return node.Kind == yamlast.ScalarNode && node.Value == environment
+}
+
+// isTruthy decides a condition. Empty values and YAML's spellings of false are
+// false; everything else is true.
+func isTruthy(node *yamlast.Node) bool {
+	switch node.Kind {
+	case yamlast.ScalarNode:
+		switch strings.ToLower(strings.TrimSpace(node.Value)) {
+		case "", "false", "no", "off", "n", "0", "~", "null":
+			return false
+		}
+		return true
+
+	case yamlast.MappingNode, yamlast.SequenceNode:
+		return len(node.Children) > 0
+	}
+
+	return false
+}
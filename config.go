@@ -1,42 +1,384 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 
 	"github.com/commondream/yamlast"
 )
 
+const (
+	// ConfigFile is the project config file cftool reads settings from.
+	ConfigFile = "config.yml"
+
+	defaultVaultPath   = "vault"
+	defaultImportsPath = "imports"
+	defaultFilesPath   = "files"
+	defaultArtifacts   = "artifacts"
+	defaultIndent      = 2
+)
+
+// ArtifactSettings say where packaged artifacts, like Lambda zips, are written
+// and which S3 bucket and key prefix they're uploaded to.
+type ArtifactSettings struct {
+	Path   string
+	Bucket string
+	Prefix string
+}
+
 // Config represents the configuration of cftool for an execution.
 type Config struct {
-	VaultKey []byte
-	VaultAST *yamlast.Node
+	Root          string
+	ImportsPath   string
+	FilesPath     string
+	Region        string
+	Artifacts     ArtifactSettings
+	Environment   string
+	EnvVars       []string
+	OutputIndent  int
+	CompactOutput bool
+	ConfigAST     *yamlast.Node
+
+	KeyProvider     KeyProvider
+	VaultKey        []byte
+	VaultPassphrase bool
+	VaultPath       string
+	VaultName       string
+	VaultAST        *yamlast.Node
+
+	vaultLoaded  bool
+	vaultErr     error
+	vaultOptions VaultOptions
+	passphrase   []byte
+	identity     *Identity
+}
+
+// LoadConfig loads the config of the project the current directory is in.
+func LoadConfig() (*Config, error) {
+	return LoadConfigFrom(".")
+}
+
+// LoadConfigFrom loads the config of the project dir is in. Paths in the
+// config are relative to the project root.
+func LoadConfigFrom(dir string) (*Config, error) {
+	config := Config{
+		Root:        FindProjectRoot(dir),
+		VaultPath:   defaultVaultPath,
+		ImportsPath: defaultImportsPath,
+		FilesPath:   defaultFilesPath,
+		Artifacts:   ArtifactSettings{Path: defaultArtifacts},
+	}
+
+	err := config.LoadConfigFile(config.projectPath(ConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	config.loadKeys()
+
+	return &config, nil
 }
 
-// LoadConfig loads a config.
-func LoadConfig() *Config {
-	config := Config{}
+// loadKeys picks up the vault key provider selected by the project's
+// .vaultkey file. Without one, only recipient vaults can be used.
+func (config *Config) loadKeys() {
+	config.KeyProvider = nil
+	config.VaultKey = nil
+	config.VaultPassphrase = false
 
-	vaultKey, keyErr := LoadVaultKey()
+	provider, keyErr := config.LoadKeyProvider()
 	if keyErr == nil {
-		config.VaultKey = vaultKey
+		config.KeyProvider = provider
+		if _, ok := provider.(*FileKeyProvider); ok {
+			vaultKey, err := provider.LoadKey()
+			if err == nil {
+				config.VaultKey = vaultKey
+			}
+		}
+	} else if keyErr == errPassphraseKey {
+		config.VaultPassphrase = true
+	}
+}
+
+// LoadConfigFile reads project settings from a config.yml file. A missing file
+// leaves the defaults in place.
+func (config *Config) LoadConfigFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	doc, err := yamlast.Parse(data)
+	if err != nil {
+		return fmt.Errorf("Error parsing %s: %s", path, err.Error())
+	}
+	if doc == nil || len(doc.Children) == 0 {
+		return nil
+	}
+	if doc.Children[0].Kind != yamlast.MappingNode {
+		return fmt.Errorf("Error parsing %s: expected a mapping", path)
+	}
+	config.ConfigAST = doc
+
+	err = config.applySettings(doc.Children[0])
+	if err != nil {
+		return fmt.Errorf("Error in %s: %s", path, err.Error())
+	}
+
+	environments := selectNode(doc, "Environments")
+	if environments != nil && environments.Kind != yamlast.MappingNode {
+		return fmt.Errorf("Error in %s: Environments must be a mapping", path)
 	}
 
-	if config.VaultKey != nil {
-		path := "vault"
-		encryptedVaultData, vaultFileErr := ioutil.ReadFile(path)
+	return nil
+}
+
+// SetEnvironment makes name the active environment, applying its overrides
+// from config.yml to the settings. Key providers are picked up again, since
+// the environment can use a different region.
+func (config *Config) SetEnvironment(name string) error {
+	config.Environment = name
+
+	settings := config.settings()
+	if settings == nil || name == "" {
+		return nil
+	}
+
+	err := config.applySettings(settings)
+	if err != nil {
+		return err
+	}
+	config.loadKeys()
+
+	return nil
+}
+
+// HasEnvironment is true when config.yml lists the environment name.
+func (config *Config) HasEnvironment(name string) bool {
+	return selectNode(config.ConfigAST, formatSelector([]selectorPart{{Key: "Environments"}, {Key: name}})) != nil
+}
+
+// EnvVarAllowed is true when config.yml lets templates read the environment
+// variable name.
+func (config *Config) EnvVarAllowed(name string) bool {
+	for _, allowed := range config.EnvVars {
+		if allowed == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ConfigValue returns a copy of the config.yml value at selector, with the
+// active environment's overrides applied.
+func (config *Config) ConfigValue(selector string) (*yamlast.Node, error) {
+	node := selectNode(config.settings(), selector)
+	if node == nil {
+		return nil, fmt.Errorf("Unknown config value: %s", selector)
+	}
+
+	return copyNode(node), nil
+}
+
+// settings returns the config.yml mapping, merged with the overrides of the
+// active environment when there is one.
+func (config *Config) settings() *yamlast.Node {
+	if config.ConfigAST == nil || len(config.ConfigAST.Children) == 0 {
+		return nil
+	}
+
+	root := config.ConfigAST.Children[0]
+	if config.Environment == "" {
+		return root
+	}
+
+	overlay := selectNode(root, formatSelector([]selectorPart{{Key: "Environments"}, {Key: config.Environment}}))
+	if overlay == nil || overlay.Kind != yamlast.MappingNode {
+		return root
+	}
+
+	return mergeNodes(root, overlay)
+}
 
-		if vaultFileErr == nil && len(encryptedVaultData) > 0 {
-			decryptedVault := Decrypt(string(encryptedVaultData), config.VaultKey)
+// applySettings copies the settings found in a config mapping onto config.
+// Settings that aren't present are left as they are.
+func (config *Config) applySettings(settings *yamlast.Node) error {
+	values := map[string]*string{
+		"Imports":    &config.ImportsPath,
+		"Files":      &config.FilesPath,
+		"Region":     &config.Region,
+		"Vault.Path": &config.VaultPath,
+		"Vault.Name": &config.VaultName,
 
-			var err error
-			config.VaultAST, err = yamlast.Parse([]byte(decryptedVault))
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error parsing vault yaml: %s\n", err.Error())
+		"Artifacts.Path":   &config.Artifacts.Path,
+		"Artifacts.Bucket": &config.Artifacts.Bucket,
+		"Artifacts.Prefix": &config.Artifacts.Prefix,
+	}
+	for selector, value := range values {
+		node := selectNode(settings, selector)
+		if node == nil {
+			continue
+		}
+		if node.Kind != yamlast.ScalarNode {
+			return fmt.Errorf("%s must be a string", selector)
+		}
+		*value = node.Value
+	}
+
+	envVars := selectNode(settings, "EnvVars")
+	if envVars != nil {
+		if envVars.Kind != yamlast.SequenceNode {
+			return fmt.Errorf("EnvVars must be a list of names")
+		}
+		config.EnvVars = nil
+		for _, name := range envVars.Children {
+			if name.Kind != yamlast.ScalarNode {
+				return fmt.Errorf("EnvVars must be a list of names")
 			}
+			config.EnvVars = append(config.EnvVars, name.Value)
+		}
+	}
+
+	indent := selectNode(settings, "Output.Indent")
+	if indent != nil {
+		n, err := strconv.Atoi(indent.Value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("Output.Indent must be a positive number of spaces")
 		}
+		config.OutputIndent = n
+	}
+
+	compact := selectNode(settings, "Output.Compact")
+	if compact != nil {
+		b, err := strconv.ParseBool(compact.Value)
+		if err != nil {
+			return fmt.Errorf("Output.Compact must be true or false")
+		}
+		config.CompactOutput = b
+	}
+
+	return nil
+}
+
+// LoadVault decrypts and parses the vault the first time it's needed. The
+// vault is left empty when there's no vault file yet, but a vault file that
+// can't be decrypted is an error, so it's never mistaken for an empty vault
+// and overwritten.
+func (config *Config) LoadVault() error {
+	if config.vaultLoaded {
+		return config.vaultErr
+	}
+	config.vaultLoaded = true
+	config.vaultErr = config.loadVault()
+
+	return config.vaultErr
+}
+
+func (config *Config) loadVault() error {
+	encryptedVaultData, err := ioutil.ReadFile(config.projectPath(config.VaultPath))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(encryptedVaultData)) == 0 {
+		return nil
+	}
+
+	header, _, err := ParseVault(encryptedVaultData)
+	if err != nil {
+		return err
+	}
+
+	decryptedVault, err := config.DecryptVault(encryptedVaultData, config.expectedVaultName())
+	if err != nil {
+		return err
+	}
+	config.vaultOptions = header.Options()
+
+	config.VaultAST, err = yamlast.Parse(decryptedVault)
+	if err != nil {
+		return fmt.Errorf("Error parsing vault yaml: %s", err.Error())
 	}
 
-	return &config
+	return nil
+}
+
+// SaveVault encrypts VaultAST and writes it back to the vault file. A new
+// vault is bound to its expected name.
+func (config *Config) SaveVault() error {
+	options := config.vaultOptions
+	if options.Name == "" {
+		options.Name = config.expectedVaultName()
+	}
+
+	encrypted, err := config.EncryptVault(FormatYAML(config.VaultAST), options)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(config.projectPath(config.VaultPath), []byte(encrypted), 0644)
+}
+
+// projectPath resolves a path from the config against the project root.
+func (config *Config) projectPath(path string) string {
+	if filepath.IsAbs(path) || config.Root == "" {
+		return path
+	}
+
+	return filepath.Join(config.Root, path)
+}
+
+// relativePath turns a path given on the command line into one relative to
+// the project root, so it matches paths written in the config.
+func (config *Config) relativePath(path string) string {
+	root, err := filepath.Abs(config.Root)
+	if err != nil {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return path
+	}
+
+	return rel
+}
+
+// expectedVaultName is the name a bound vault has to carry to be accepted:
+// VaultName when it's set, or else the vault's path.
+func (config *Config) expectedVaultName() string {
+	if config.VaultName != "" {
+		return config.VaultName
+	}
+
+	return vaultNameForPath(config.VaultPath)
+}
+
+// vaultNameFor returns the name the vault file at path is bound to by
+// default: the configured vault's expected name for the configured vault, and
+// its path within the project for any other file.
+func (config *Config) vaultNameFor(path string) string {
+	rel := config.relativePath(path)
+	if rel == filepath.Clean(config.VaultPath) {
+		return config.expectedVaultName()
+	}
+
+	return vaultNameForPath(rel)
+}
+
+// vaultNameForPath returns the name a vault file at path is expected to be
+// bound to when no name is given explicitly.
+func vaultNameForPath(path string) string {
+	return filepath.ToSlash(filepath.Clean(path))
 }
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/commondream/yamlast"
+)
+
+// The ways !file can embed a file. FileModeJoin is the default.
+const (
+	// FileModeJoin embeds the file as an Fn::Join of its lines.
+	FileModeJoin = "join"
+
+	// FileModeString embeds the file as a plain string.
+	FileModeString = "string"
+
+	// FileModeBase64 embeds the file wrapped in Fn::Base64, as UserData
+	// needs.
+	FileModeBase64 = "base64"
+
+	// FileModeSub embeds the file wrapped in Fn::Sub, so ${} variables in it
+	// are substituted by CloudFormation.
+	FileModeSub = "sub"
+
+	// FileModeBytes embeds the base64 encoding of the file, for content that
+	// isn't UTF-8 text.
+	FileModeBytes = "bytes"
+)
+
+// Matches references embedded in files, like {{ref "Bucket"}},
+// {{getatt "Db" "Endpoint.Address"}} or {{vault "Db.Password"}}.
+var fileRefRegex = regexp.MustCompile(`\{\{\s*(ref|getatt|vault)((?:\s+"[^"]*")*)\s*\}\}`)
+var fileRefArgRegex = regexp.MustCompile(`"([^"]*)"`)
+
+// fileRef is a reference embedded in a file.
+type fileRef struct {
+	Function string
+	Args     []string
+}
+
+// fileHandler embeds a file from the files directory. The mode is chosen with
+// a tag suffix, like !file:base64 userdata.sh, or by tagging a mapping with
+// Path and Mode keys.
+func (template *Template) fileHandler(node *yamlast.Node) (*yamlast.Node, error) {
+	name := node.Value
+	mode := strings.TrimPrefix(strings.TrimPrefix(node.Tag, "!file"), ":")
+
+	if node.Kind == yamlast.MappingNode {
+		pathNode := selectNode(node, "Path")
+		if pathNode == nil || pathNode.Kind != yamlast.ScalarNode {
+			return nil, fmt.Errorf("%s needs a Path", node.Tag)
+		}
+		name = pathNode.Value
+
+		if modeNode := selectNode(node, "Mode"); modeNode != nil {
+			mode = modeNode.Value
+		}
+	} else if node.Kind != yamlast.ScalarNode {
+		return nil, fmt.Errorf("%s needs a path", node.Tag)
+	}
+
+	if mode == "" {
+		mode = FileModeJoin
+	}
+
+	path := template.Config.projectPath(filepath.Join(template.Config.FilesPath, name))
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading file %s: %s", path, err.Error())
+	}
+
+	if mode == FileModeBytes {
+		return &yamlast.Node{Kind: yamlast.ScalarNode, Value: base64.StdEncoding.EncodeToString(data)}, nil
+	}
+
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("File %s isn't UTF-8 text; embed it with mode %s instead", path, FileModeBytes)
+	}
+	content := string(data)
+
+	switch mode {
+	case FileModeJoin:
+		var parts []*yamlast.Node
+		for _, line := range strings.SplitAfter(content, "\n") {
+			lineParts, err := template.fileParts(line)
+			if err != nil {
+				return nil, fmt.Errorf("Error in file %s: %s", path, err)
+			}
+			parts = append(parts, lineParts...)
+		}
+
+		return joinNode(parts), nil
+
+	case FileModeString, FileModeBase64:
+		parts, err := template.fileParts(content)
+		if err != nil {
+			return nil, fmt.Errorf("Error in file %s: %s", path, err)
+		}
+
+		value := template.joinScalarParts(parts)
+		if value == nil {
+			value = joinNode(parts)
+		}
+
+		if mode == FileModeBase64 {
+			return intrinsicNode("Fn::Base64", value), nil
+		}
+		return value, nil
+
+	case FileModeSub:
+		return template.fileSub(content, path)
+
+	default:
+		return nil, fmt.Errorf("Unknown !file mode: %s", mode)
+	}
+}
+
+// parseFileRefs finds the references embedded in text. Each match is returned
+// as the start and end of the reference in text.
+func parseFileRefs(text string) ([][]int, []fileRef, error) {
+	matches := fileRefRegex.FindAllStringSubmatchIndex(text, -1)
+
+	var refs []fileRef
+	for _, match := range matches {
+		ref := fileRef{Function: text[match[2]:match[3]]}
+		for _, arg := range fileRefArgRegex.FindAllStringSubmatch(text[match[4]:match[5]], -1) {
+			ref.Args = append(ref.Args, arg[1])
+		}
+
+		expected := 1
+		if ref.Function == "getatt" {
+			expected = 2
+		}
+		if len(ref.Args) != expected {
+			return nil, nil, fmt.Errorf("%s takes %d argument(s): %s", ref.Function, expected, text[match[0]:match[1]])
+		}
+
+		refs = append(refs, ref)
+	}
+
+	return matches, refs, nil
+}
+
+// fileParts splits text into plain strings and the intrinsic function nodes
+// of the references embedded in it.
+func (template *Template) fileParts(text string) ([]*yamlast.Node, error) {
+	matches, refs, err := parseFileRefs(text)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []*yamlast.Node
+	last := 0
+	for i, match := range matches {
+		if match[0] > last {
+			parts = append(parts, &yamlast.Node{Kind: yamlast.ScalarNode, Value: text[last:match[0]]})
+		}
+		last = match[1]
+
+		part, err := template.fileRefNode(refs[i])
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	if last < len(text) {
+		parts = append(parts, &yamlast.Node{Kind: yamlast.ScalarNode, Value: text[last:]})
+	}
+
+	return parts, nil
+}
+
+// fileRefNode returns the node a reference embedded in a file stands for.
+func (template *Template) fileRefNode(ref fileRef) (*yamlast.Node, error) {
+	switch ref.Function {
+	case "ref":
+		return template.refHandler("!ref", ref.Args[0])
+
+	case "getatt":
+		return intrinsicNode("Fn::GetAtt", &yamlast.Node{
+			Kind: yamlast.SequenceNode,
+			Children: []*yamlast.Node{
+				{Kind: yamlast.ScalarNode, Value: ref.Args[0]},
+				{Kind: yamlast.ScalarNode, Value: ref.Args[1]},
+			},
+		}), nil
+
+	default:
+		_, err := template.fileVaultValue(ref.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return template.vaultHandler("!vault", ref.Args[0])
+	}
+}
+
+// fileVaultValue returns the vault value a file refers to. Unlike with the
+// !vault tag, values that are missing or aren't strings are errors.
+func (template *Template) fileVaultValue(selector string) (*yamlast.Node, error) {
+	err := template.Config.LoadVault()
+	if err != nil {
+		return nil, err
+	}
+
+	node := selectNode(template.Config.VaultAST, selector)
+	if node == nil || node.Kind != yamlast.ScalarNode {
+		return nil, fmt.Errorf("Unknown vault value: %s", selector)
+	}
+
+	return node, nil
+}
+
+// fileSub wraps a file in Fn::Sub, turning the references embedded in it into
+// ${} variables. Vault values are written out, escaped so Fn::Sub leaves them
+// alone.
+func (template *Template) fileSub(content string, path string) (*yamlast.Node, error) {
+	matches, refs, err := parseFileRefs(content)
+	if err != nil {
+		return nil, fmt.Errorf("Error in file %s: %s", path, err)
+	}
+
+	var out strings.Builder
+	var secrets []string
+	last := 0
+	for i, match := range matches {
+		out.WriteString(content[last:match[0]])
+		last = match[1]
+
+		ref := refs[i]
+		switch ref.Function {
+		case "ref":
+			out.WriteString("${" + ref.Args[0] + "}")
+		case "getatt":
+			out.WriteString("${" + ref.Args[0] + "." + ref.Args[1] + "}")
+		default:
+			value, err := template.fileVaultValue(ref.Args[0])
+			if err != nil {
+				return nil, fmt.Errorf("Error in file %s: %s", path, err)
+			}
+
+			if template.SecretsAsParameters {
+				name, err := template.vaultHandler("!vault", ref.Args[0])
+				if err != nil {
+					return nil, err
+				}
+				out.WriteString("${" + selectNode(name, "Ref").Value + "}")
+			} else {
+				out.WriteString(strings.Replace(value.Value, "${", "${!", -1))
+				secrets = append(secrets, ref.Args[0])
+			}
+		}
+	}
+	out.WriteString(content[last:])
+
+	sub := &yamlast.Node{Kind: yamlast.ScalarNode, Value: out.String()}
+	if len(secrets) > 0 {
+		template.markSecret(sub, "!file vault "+strings.Join(secrets, ", "))
+	}
+
+	return intrinsicNode("Fn::Sub", sub), nil
+}
+
+// joinScalarParts joins parts into a single string when they're all strings,
+// keeping track of vault values in them. It returns nil when a part is an
+// intrinsic function.
+func (template *Template) joinScalarParts(parts []*yamlast.Node) *yamlast.Node {
+	var value strings.Builder
+	var secrets []string
+	for _, part := range parts {
+		if part.Kind != yamlast.ScalarNode {
+			return nil
+		}
+		value.WriteString(part.Value)
+
+		if source, ok := template.secretNodes[part]; ok {
+			secrets = append(secrets, source)
+		}
+	}
+
+	node := &yamlast.Node{Kind: yamlast.ScalarNode, Value: value.String()}
+	if len(secrets) > 0 {
+		template.markSecret(node, "!file "+strings.Join(secrets, ", "))
+	}
+
+	return node
+}
+
+// joinNode joins parts with Fn::Join and an empty delimiter.
+func joinNode(parts []*yamlast.Node) *yamlast.Node {
+	return intrinsicNode("Fn::Join", &yamlast.Node{
+		Kind: yamlast.SequenceNode,
+		Children: []*yamlast.Node{
+			{Kind: yamlast.ScalarNode, Value: ""},
+			{Kind: yamlast.SequenceNode, Children: parts},
+		},
+	})
+}
+
+// jsonHandler parses a JSON file from the files directory into nodes, keeping
+// the order of its keys.
+func (template *Template) jsonHandler(tag string, value string) (*yamlast.Node, error) {
+	path := template.Config.projectPath(filepath.Join(template.Config.FilesPath, value))
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading file %s: %s", path, err.Error())
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	node, err := decodeJSONNode(decoder)
+	if err == nil {
+		if _, extraErr := decoder.Token(); extraErr != io.EOF {
+			err = errors.New("unexpected data after the JSON value")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing JSON file %s: %s", path, err)
+	}
+
+	return node, nil
+}
+
+// decodeJSONNode reads the next JSON value from decoder as a node.
+func decodeJSONNode(decoder *json.Decoder) (*yamlast.Node, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token := token.(type) {
+	case json.Delim:
+		if token == '{' {
+			node := &yamlast.Node{Kind: yamlast.MappingNode}
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := decodeJSONNode(decoder)
+				if err != nil {
+					return nil, err
+				}
+				node.Children = append(node.Children,
+					&yamlast.Node{Kind: yamlast.ScalarNode, Value: key.(string)}, value)
+			}
+			_, err = decoder.Token()
+			return node, err
+		}
+
+		node := &yamlast.Node{Kind: yamlast.SequenceNode}
+		for decoder.More() {
+			value, err := decodeJSONNode(decoder)
+			if err != nil {
+				return nil, err
+			}
+			node.Children = append(node.Children, value)
+		}
+		_, err = decoder.Token()
+		return node, err
+
+	case nil:
+		return &yamlast.Node{Kind: yamlast.ScalarNode, Value: "null"}, nil
+
+	default:
+		return &yamlast.Node{Kind: yamlast.ScalarNode, Value: fmt.Sprint(token)}, nil
+	}
+}
+
+// textHandler embeds a file from the files directory as a single string.
+// JSON files are checked and compacted first, as properties like a
+// dashboard's DashboardBody expect.
+func (template *Template) textHandler(tag string, value string) (*yamlast.Node, error) {
+	path := template.Config.projectPath(filepath.Join(template.Config.FilesPath, value))
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading file %s: %s", path, err.Error())
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var compacted bytes.Buffer
+		err = json.Compact(&compacted, data)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing JSON file %s: %s", path, err)
+		}
+		data = compacted.Bytes()
+	}
+
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("File %s isn't UTF-8 text", path)
+	}
+
+	return &yamlast.Node{Kind: yamlast.ScalarNode, Value: string(data)}, nil
+}
+
+// intrinsicNode returns a mapping calling the intrinsic function name with
+// argument, like { "Fn::Base64": argument }.
+func intrinsicNode(name string, argument *yamlast.Node) *yamlast.Node {
+	return &yamlast.Node{
+		Kind:     yamlast.MappingNode,
+		Children: []*yamlast.Node{{Kind: yamlast.ScalarNode, Value: name}, argument},
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+func TestWriteFileAtomicNeverLoosensMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(path, []byte("ciphertext"), 0644)
+	assert.Nil(t, err)
+
+	// Plaintext written over a world readable file is still private.
+	err = writeFileAtomic(path, []byte("plaintext"), 0600)
+	assert.Nil(t, err)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// A private file stays private.
+	err = writeFileAtomic(path, []byte("ciphertext"), 0644)
+	assert.Nil(t, err)
+	info, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/commondream/yamlast"
+)
+
+// ForeachTag marks a mapping with Items and Body keys that's replaced by a copy
+// of Body for every item in Items.
+const ForeachTag = "!foreach"
+
+// Matches ${index}, ${item} and ${item.Selector} placeholders.
+var placeholderRegex = regexp.MustCompile(`\$\{(index|item(\.[^}]+)?)\}`)
+
+// expandLoops replaces the !foreach children of node with their expansions.
+// In a mapping the entries of each expanded body take the place of the
+// !foreach entry, whose key is only a label. In a sequence each expanded body
+// becomes an item.
+func (template *Template) expandLoops(node *yamlast.Node) (bool, error) {
+	expanded := false
+
+	switch node.Kind {
+	case yamlast.MappingNode:
+		for i := 0; i+1 < len(node.Children); {
+			if node.Children[i+1].Tag != ForeachTag {
+				i += 2
+				continue
+			}
+
+			bodies, err := template.expandForeach(node.Children[i+1])
+			if err != nil {
+				return false, err
+			}
+
+			var entries []*yamlast.Node
+			for _, body := range bodies {
+				if body.Kind != yamlast.MappingNode {
+					return false, fmt.Errorf("%s %s needs a mapping as its Body", ForeachTag, node.Children[i].Value)
+				}
+				entries = append(entries, body.Children...)
+			}
+
+			// Entries are checked again, so a body can contain more loops.
+			node.Children = append(node.Children[:i], append(entries, node.Children[i+2:]...)...)
+			expanded = true
+		}
+
+	case yamlast.SequenceNode:
+		for i := 0; i < len(node.Children); {
+			if node.Children[i].Tag != ForeachTag {
+				i++
+				continue
+			}
+
+			bodies, err := template.expandForeach(node.Children[i])
+			if err != nil {
+				return false, err
+			}
+
+			node.Children = append(node.Children[:i], append(bodies, node.Children[i+1:]...)...)
+			expanded = true
+		}
+	}
+
+	if expanded && node.Kind == yamlast.MappingNode {
+		return true, checkUniqueKeys(node, "Duplicate key generated by "+ForeachTag)
+	}
+
+	return expanded, nil
+}
+
+// expandForeach returns a copy of a loop's Body for every item in its Items,
+// with placeholders filled in.
+func (template *Template) expandForeach(loop *yamlast.Node) ([]*yamlast.Node, error) {
+	if loop.Kind != yamlast.MappingNode {
+		return nil, fmt.Errorf("%s needs a mapping with Items and Body", ForeachTag)
+	}
+
+	items := selectNode(loop, "Items")
+	body := selectNode(loop, "Body")
+	if items == nil || body == nil {
+		return nil, fmt.Errorf("%s needs a mapping with Items and Body", ForeachTag)
+	}
+
+	// Items can come from a tag like !meta or !config.
+	items, err := template.resolveNode(items)
+	if err != nil {
+		return nil, err
+	}
+	if items.Kind != yamlast.SequenceNode {
+		return nil, fmt.Errorf("%s Items must be a list", ForeachTag)
+	}
+
+	var bodies []*yamlast.Node
+	for index, item := range items.Children {
+		expanded, err := substitutePlaceholders(copyNode(body), item, index)
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, expanded)
+	}
+
+	return bodies, nil
+}
+
+// substitutePlaceholders fills in the placeholders of a loop body for one
+// item. A scalar that's nothing but an ${item} placeholder is replaced by the
+// item itself, so items can be mappings or lists. Nested loop bodies are left
+// for their own loop, so placeholders there refer to the inner loop's items.
+func substitutePlaceholders(node *yamlast.Node, item *yamlast.Node, index int) (*yamlast.Node, error) {
+	switch node.Kind {
+	case yamlast.ScalarNode:
+		match := placeholderRegex.FindStringSubmatch(node.Value)
+		if match != nil && match[0] == node.Value && match[1] != "index" {
+			value, err := placeholderValue(match[1], item)
+			if err != nil {
+				return nil, err
+			}
+			if value.Kind != yamlast.ScalarNode {
+				return copyNode(value), nil
+			}
+		}
+
+		var err error
+		node.Value = placeholderRegex.ReplaceAllStringFunc(node.Value, func(placeholder string) string {
+			name := placeholderRegex.FindStringSubmatch(placeholder)[1]
+			if name == "index" {
+				return strconv.Itoa(index)
+			}
+
+			value, valueErr := placeholderValue(name, item)
+			if valueErr == nil && value.Kind != yamlast.ScalarNode {
+				valueErr = fmt.Errorf("${%s} isn't a single value", name)
+			}
+			if valueErr != nil {
+				err = valueErr
+				return placeholder
+			}
+
+			return value.Value
+		})
+		if err != nil {
+			return nil, err
+		}
+
+	case yamlast.MappingNode:
+		for i := 0; i+1 < len(node.Children); i += 2 {
+			if node.Tag == ForeachTag && node.Children[i].Value != "Items" {
+				continue
+			}
+
+			key, err := substitutePlaceholders(node.Children[i], item, index)
+			if err != nil {
+				return nil, err
+			}
+			if key.Kind != yamlast.ScalarNode {
+				return nil, errors.New("Mapping keys can't be replaced by lists or mappings")
+			}
+			node.Children[i] = key
+
+			node.Children[i+1], err = substitutePlaceholders(node.Children[i+1], item, index)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	case yamlast.SequenceNode:
+		for i, child := range node.Children {
+			var err error
+			node.Children[i], err = substitutePlaceholders(child, item, index)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return node, nil
+}
+
+// placeholderValue returns the item, or the part of it a selector like
+// item.Name points to.
+func placeholderValue(name string, item *yamlast.Node) (*yamlast.Node, error) {
+	if name == "item" {
+		return item, nil
+	}
+
+	value := selectNode(item, name[len("item."):])
+	if value == nil {
+		return nil, fmt.Errorf("Unknown item value: ${%s}", name)
+	}
+
+	return value, nil
+}
+
+// checkUniqueKeys fails with message when a mapping has the same key twice.
+func checkUniqueKeys(node *yamlast.Node, message string) error {
+	if node == nil || node.Kind != yamlast.MappingNode {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < len(node.Children)/2; i++ {
+		key := node.Children[i*2].Value
+		if seen[key] {
+			return fmt.Errorf("%s: %s", message, key)
+		}
+		seen[key] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// KMSVaultKeyPrefix is written to .vaultkey, followed by a key ID, to wrap
+	// vault data keys with AWS KMS.
+	KMSVaultKeyPrefix = "kms:"
+
+	// LocalKMSVaultKeyPrefix is written to .vaultkey, followed by a key ID, to
+	// wrap vault data keys with the file backed local KMS.
+	LocalKMSVaultKeyPrefix = "local-kms:"
+
+	// VaultKeyFile selects and holds the key vaults are encrypted with. It's
+	// read from the project root.
+	VaultKeyFile = ".vaultkey"
+
+	defaultLocalKMSPath = ".cftool-kms"
+)
+
+// KeyProvider supplies the keys vaults are encrypted with. Providers either
+// hand out a key directly or wrap a fresh data key for every vault, storing the
+// wrapped copy in the vault header (envelope encryption).
+type KeyProvider interface {
+	// Name identifies the provider in vault headers.
+	Name() string
+
+	// LoadKey returns the key to encrypt vaults with directly. Providers that
+	// only do envelope encryption return an error.
+	LoadKey() ([]byte, error)
+
+	// GenerateDataKey returns a new data key along with its wrapped form.
+	GenerateDataKey() ([]byte, []byte, error)
+
+	// UnwrapDataKey recovers a data key from its wrapped form.
+	UnwrapDataKey(wrapped []byte) ([]byte, error)
+}
+
+// FileKeyProvider uses the base64 key stored in a .vaultkey file.
+type FileKeyProvider struct {
+	Path string
+}
+
+// Name implements KeyProvider.
+func (provider *FileKeyProvider) Name() string {
+	return "file"
+}
+
+// LoadKey implements KeyProvider.
+func (provider *FileKeyProvider) LoadKey() ([]byte, error) {
+	return loadVaultKeyFile(provider.Path)
+}
+
+// GenerateDataKey implements KeyProvider by wrapping a random key with the
+// key from the file.
+func (provider *FileKeyProvider) GenerateDataKey() ([]byte, []byte, error) {
+	key, err := provider.LoadKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey, err := GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err := encrypt(dataKey, key, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dataKey, []byte(wrapped), nil
+}
+
+// UnwrapDataKey implements KeyProvider.
+func (provider *FileKeyProvider) UnwrapDataKey(wrapped []byte) ([]byte, error) {
+	key, err := provider.LoadKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return decrypt(string(wrapped), key, nil)
+}
+
+// KMSClient is the part of the AWS KMS API that envelope encryption needs.
+type KMSClient interface {
+	// GenerateDataKey returns a new 256 bit data key as plaintext and as a
+	// ciphertext blob encrypted under the KMS key keyID.
+	GenerateDataKey(keyID string) ([]byte, []byte, error)
+
+	// Decrypt returns the plaintext of a ciphertext blob. The blob identifies
+	// the KMS key it was encrypted under.
+	Decrypt(blob []byte) ([]byte, error)
+}
+
+// KMSKeyProvider wraps vault data keys with a KMS key, so anyone allowed to
+// use the KMS key, like a CI role, can unlock the vault.
+type KMSKeyProvider struct {
+	ProviderName string
+	KeyID        string
+	KMS          KMSClient
+}
+
+// Name implements KeyProvider.
+func (provider *KMSKeyProvider) Name() string {
+	return provider.ProviderName
+}
+
+// LoadKey implements KeyProvider. KMS keys never leave KMS, so vaults are
+// always encrypted with a wrapped data key.
+func (provider *KMSKeyProvider) LoadKey() ([]byte, error) {
+	return nil, errors.New("KMS keys can only be used to wrap data keys")
+}
+
+// GenerateDataKey implements KeyProvider.
+func (provider *KMSKeyProvider) GenerateDataKey() ([]byte, []byte, error) {
+	if provider.KeyID == "" {
+		return nil, nil, errors.New("No KMS key ID configured")
+	}
+
+	return provider.KMS.GenerateDataKey(provider.KeyID)
+}
+
+// UnwrapDataKey implements KeyProvider.
+func (provider *KMSKeyProvider) UnwrapDataKey(wrapped []byte) ([]byte, error) {
+	return provider.KMS.Decrypt(wrapped)
+}
+
+// LoadKeyProvider reads the project's .vaultkey file and returns the provider
+// it selects. errPassphraseKey is returned when it selects passphrase derived
+// keys.
+func (config *Config) LoadKeyProvider() (KeyProvider, error) {
+	path := config.projectPath(VaultKeyFile)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	value := string(bytes.TrimSpace(data))
+	switch {
+	case value == PassphraseVaultKey:
+		return nil, errPassphraseKey
+	case strings.HasPrefix(value, KMSVaultKeyPrefix):
+		return config.newKMSKeyProvider("kms", strings.TrimPrefix(value, KMSVaultKeyPrefix)), nil
+	case strings.HasPrefix(value, LocalKMSVaultKeyPrefix):
+		return config.newKMSKeyProvider("local-kms", strings.TrimPrefix(value, LocalKMSVaultKeyPrefix)), nil
+	default:
+		return &FileKeyProvider{Path: path}, nil
+	}
+}
+
+// newKeyProvider returns the provider named in a vault header, ready to
+// unwrap data keys.
+func (config *Config) newKeyProvider(name string) KeyProvider {
+	switch name {
+	case "file":
+		return &FileKeyProvider{Path: config.projectPath(VaultKeyFile)}
+	case "kms", "local-kms":
+		return config.newKMSKeyProvider(name, "")
+	default:
+		return nil
+	}
+}
+
+// newKMSKeyProvider returns a KMS provider. AWS KMS is used in the configured
+// region.
+func (config *Config) newKMSKeyProvider(name string, keyID string) *KMSKeyProvider {
+	if name == "local-kms" {
+		return &KMSKeyProvider{ProviderName: name, KeyID: keyID, KMS: config.LocalKMS()}
+	}
+
+	return &KMSKeyProvider{ProviderName: name, KeyID: keyID, KMS: &AWSKMS{Region: config.Region}}
+}
+
+// loadVaultKeyFile loads a base64 encoded vault key.
+func loadVaultKeyFile(path string) ([]byte, error) {
+	keyBase64, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	key := make([]byte, base64.StdEncoding.DecodedLen(len(keyBase64)))
+	l, err := base64.StdEncoding.Decode(key, keyBase64)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if l < 32 {
+		return []byte{}, errors.New("Invalid vault key")
+	}
+
+	return key[:32], nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+func TestLocalKMSKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	kms := &LocalKMS{Path: filepath.Join(dir, "kms")}
+	err = kms.CreateKey("alias/cftool")
+	assert.Nil(t, err)
+
+	provider := &KMSKeyProvider{ProviderName: "local-kms", KeyID: "alias/cftool", KMS: kms}
+	config := &Config{KeyProvider: provider}
+
+	encrypted, err := config.EncryptVault([]byte("Db: secret"), VaultOptions{})
+	assert.Nil(t, err)
+
+	header, _, err := ParseVault([]byte(encrypted))
+	assert.Nil(t, err)
+	assert.Equal(t, "local-kms", header.KeyProvider)
+
+	decrypted, err := config.DecryptVault([]byte(encrypted), "")
+	assert.Nil(t, err)
+	assert.Equal(t, "Db: secret", string(decrypted))
+
+	other := &LocalKMS{Path: filepath.Join(dir, "other")}
+	err = other.CreateKey("alias/cftool")
+	assert.Nil(t, err)
+
+	config = &Config{KeyProvider: &KMSKeyProvider{ProviderName: "local-kms", KMS: other}}
+	_, err = config.DecryptVault([]byte(encrypted), "")
+	assert.NotNil(t, err)
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := GenerateKey()
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, VaultKeyFile)
+	err = ioutil.WriteFile(path, []byte(EncodeVaultKey(key)+"\n"), 0600)
+	assert.Nil(t, err)
+
+	config := &Config{Root: dir}
+	provider, err := config.LoadKeyProvider()
+	assert.Nil(t, err)
+
+	loaded, err := provider.LoadKey()
+	assert.Nil(t, err)
+	assert.Equal(t, key, loaded)
+
+	dataKey, wrapped, err := provider.GenerateDataKey()
+	assert.Nil(t, err)
+
+	unwrapped, err := provider.UnwrapDataKey(wrapped)
+	assert.Nil(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// AWSKMS talks to AWS KMS through the aws command line tool, so it picks up
+// credentials, profiles and instance or CI roles the same way the CLI does.
+// Region overrides the CLI's region when it's set.
+type AWSKMS struct {
+	Region string
+}
+
+// GenerateDataKey implements KMSClient.
+func (kms *AWSKMS) GenerateDataKey(keyID string) ([]byte, []byte, error) {
+	var result struct {
+		Plaintext      []byte
+		CiphertextBlob []byte
+	}
+
+	err := kms.runAWS(&result, "kms", "generate-data-key", "--key-id", keyID, "--key-spec", "AES_256")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return result.Plaintext, result.CiphertextBlob, nil
+}
+
+// Decrypt implements KMSClient.
+func (kms *AWSKMS) Decrypt(blob []byte) ([]byte, error) {
+	blobFile, err := ioutil.TempFile("", "cftool-kms-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(blobFile.Name())
+
+	_, err = blobFile.Write(blob)
+	blobFile.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Plaintext []byte
+	}
+
+	err = kms.runAWS(&result, "kms", "decrypt", "--ciphertext-blob", "fileb://"+blobFile.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Plaintext, nil
+}
+
+// runAWS runs an aws CLI command and decodes its JSON output into result.
+func (kms *AWSKMS) runAWS(result interface{}, args ...string) error {
+	command := append(args, "--output", "json")
+	if kms.Region != "" {
+		command = append(command, "--region", kms.Region)
+	}
+
+	cmd := exec.Command("aws", command...)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("Error running aws %s: %s", strings.Join(args[:2], " "), err)
+	}
+
+	return json.Unmarshal(out, result)
+}
+
+// LocalKMS is a stand-in for AWS KMS that keeps its master keys in a local
+// JSON file. It's meant for tests and offline use; anyone who can read the file
+// can unwrap the data keys.
+type LocalKMS struct {
+	Path string
+}
+
+// LocalKMS returns the project's local KMS, backed by the file in
+// $CFTOOL_LOCAL_KMS, or .cftool-kms in the project root by default.
+func (config *Config) LocalKMS() *LocalKMS {
+	path := os.Getenv("CFTOOL_LOCAL_KMS")
+	if path == "" {
+		path = config.projectPath(defaultLocalKMSPath)
+	}
+
+	return &LocalKMS{Path: path}
+}
+
+// CreateKey adds a new master key, leaving an existing key with the same ID in
+// place.
+func (kms *LocalKMS) CreateKey(keyID string) error {
+	keys, err := kms.loadKeys()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, ok := keys[keyID]; ok {
+		return nil
+	}
+
+	keys[keyID], err = GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(kms.Path, data, 0600)
+}
+
+// GenerateDataKey implements KMSClient. The ciphertext blob is the sealed data
+// key followed by the ID of the master key that sealed it.
+func (kms *LocalKMS) GenerateDataKey(keyID string) ([]byte, []byte, error) {
+	masterKey, err := kms.masterKey(keyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey, err := GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sealed, err := encrypt(dataKey, masterKey, []byte(keyID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dataKey, []byte(sealed + ":" + keyID), nil
+}
+
+// Decrypt implements KMSClient.
+func (kms *LocalKMS) Decrypt(blob []byte) ([]byte, error) {
+	parts := strings.SplitN(string(blob), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid local KMS ciphertext")
+	}
+
+	masterKey, err := kms.masterKey(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return decrypt(parts[0], masterKey, []byte(parts[1]))
+}
+
+func (kms *LocalKMS) masterKey(keyID string) ([]byte, error) {
+	keys, err := kms.loadKeys()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading local KMS %s: %s", kms.Path, err)
+	}
+
+	key, ok := keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("Unknown local KMS key: %s", keyID)
+	}
+
+	return key, nil
+}
+
+func (kms *LocalKMS) loadKeys() (map[string][]byte, error) {
+	keys := map[string][]byte{}
+
+	data, err := ioutil.ReadFile(kms.Path)
+	if err != nil {
+		return keys, err
+	}
+
+	err = json.Unmarshal(data, &keys)
+	return keys, err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/commondream/yamlast"
+)
+
+// MaxInlineLambdaCode is the most code CloudFormation accepts in a Lambda
+// function's ZipFile property.
+const MaxInlineLambdaCode = 4096
+
+// zipTimestamp is used for every entry of a Lambda zip, so the same files
+// always make the same zip.
+var zipTimestamp = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// lambdaCodeHandler inlines a small Lambda function from the files directory
+// as a Code mapping with ZipFile.
+func (template *Template) lambdaCodeHandler(tag string, value string) (*yamlast.Node, error) {
+	path := template.Config.projectPath(filepath.Join(template.Config.FilesPath, value))
+	code, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading file %s: %s", path, err.Error())
+	}
+
+	if len(code) > MaxInlineLambdaCode {
+		return nil, fmt.Errorf("%s is %d bytes, over the %d byte limit for inline Lambda code; package it with !lambda-zip instead",
+			path, len(code), MaxInlineLambdaCode)
+	}
+
+	return &yamlast.Node{
+		Kind: yamlast.MappingNode,
+		Children: []*yamlast.Node{
+			{Kind: yamlast.ScalarNode, Value: "ZipFile"},
+			{Kind: yamlast.ScalarNode, Value: string(code)},
+		},
+	}, nil
+}
+
+// lambdaZipHandler zips a directory from the files directory into the
+// artifacts directory and returns a Code mapping pointing at where it's
+// uploaded. The key includes a hash of the zip, so changed code always gets a
+// new key and CloudFormation updates the function.
+func (template *Template) lambdaZipHandler(tag string, value string) (*yamlast.Node, error) {
+	artifacts := template.Config.Artifacts
+	if artifacts.Bucket == "" {
+		return nil, fmt.Errorf("%s needs Artifacts.Bucket to be set in %s", tag, ConfigFile)
+	}
+
+	dir := template.Config.projectPath(filepath.Join(template.Config.FilesPath, value))
+	data, err := ZipDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	name := fmt.Sprintf("%s-%s.zip", filepath.Base(filepath.Clean(dir)), hex.EncodeToString(sum[:])[:16])
+
+	artifactsPath := template.Config.projectPath(artifacts.Path)
+	err = os.MkdirAll(artifactsPath, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(artifactsPath, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err = writeFileAtomic(path, data, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &yamlast.Node{
+		Kind: yamlast.MappingNode,
+		Children: []*yamlast.Node{
+			{Kind: yamlast.ScalarNode, Value: "S3Bucket"},
+			{Kind: yamlast.ScalarNode, Value: artifacts.Bucket},
+			{Kind: yamlast.ScalarNode, Value: "S3Key"},
+			{Kind: yamlast.ScalarNode, Value: artifacts.Prefix + name},
+		},
+	}, nil
+}
+
+// ZipDirectory zips the files under dir. Entries are sorted and get a fixed
+// timestamp, so the zip only changes when the files do.
+func ZipDirectory(dir string) ([]byte, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	files := 0
+
+	// filepath.Walk visits entries in lexical order.
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		header := &zip.FileHeader{
+			Name:     filepath.ToSlash(rel),
+			Method:   zip.Deflate,
+			Modified: zipTimestamp,
+		}
+		mode := os.FileMode(0644)
+		if info.Mode()&0111 != 0 {
+			mode = 0755
+		}
+		header.SetMode(mode)
+
+		entry, err := writer.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		_, err = entry.Write(data)
+		files++
+		return err
+	})
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	if files == 0 {
+		return nil, fmt.Errorf("%s has no files to zip", dir)
+	}
+
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stvp/assert"
+)
+
+func TestZipDirectoryIsDeterministic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "lib"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "main.py"), []byte("import lib\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "lib", "__init__.py"), []byte("x = 1\n"), 0644))
+
+	first, err := ZipDirectory(dir)
+	assert.Nil(t, err)
+
+	later := time.Now().Add(time.Hour)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "main.py"), later, later))
+	second, err := ZipDirectory(dir)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(first, second))
+
+	reader, err := zip.NewReader(bytes.NewReader(first), int64(len(first)))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(reader.File))
+	assert.Equal(t, "lib/__init__.py", reader.File[0].Name)
+	assert.Equal(t, "main.py", reader.File[1].Name)
+}
+
+func TestLambdaCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "files", "api"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "files", "handler.py"), []byte("def handler(e, c):\n    pass\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "files", "big.py"), []byte(strings.Repeat("#", MaxInlineLambdaCode+1)), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "files", "api", "main.py"), []byte("pass\n"), 0644))
+
+	config := &Config{
+		Root:      dir,
+		FilesPath: "files",
+		Artifacts: ArtifactSettings{Path: "artifacts", Bucket: "builds", Prefix: "lambda/"},
+	}
+	template := NewTemplate(config)
+	err = template.LoadSource([]byte("Inline: !lambda-code handler.py\nZipped: !lambda-zip api\n"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "def handler(e, c):\n    pass\n", selectNode(template.DocumentNode, "Inline.ZipFile").Value)
+	assert.Equal(t, "builds", selectNode(template.DocumentNode, "Zipped.S3Bucket").Value)
+
+	key := selectNode(template.DocumentNode, "Zipped.S3Key").Value
+	assert.True(t, strings.HasPrefix(key, "lambda/api-"))
+	_, err = os.Stat(filepath.Join(dir, "artifacts", strings.TrimPrefix(key, "lambda/")))
+	assert.Nil(t, err)
+
+	template = NewTemplate(config)
+	err = template.LoadSource([]byte("Inline: !lambda-code big.py\n"))
+	assert.NotNil(t, err)
+}
@@ -1,43 +1,191 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/commondream/yamlast"
 )
 
 type commandHandler func(*Config)
 
 func main() {
 	commands := map[string]commandHandler{
+		"init":    initCmd,
 		"process": processCmd,
 		"vault":   vaultCmd,
 	}
 
 	flag.Parse()
 
-	config := LoadConfig()
-
 	command := flag.Arg(0)
 	handler, ok := commands[command]
-	if ok {
-		handler(config)
-	} else {
+	if !ok {
 		usage(commands)
+		return
+	}
+
+	// init creates a new project and process loads the project of its
+	// template, so neither depends on the current directory's config.
+	var config *Config
+	if command != "init" && command != "process" {
+		config = mustLoadConfig(".")
+	}
+	handler(config)
+}
+
+// mustLoadConfig loads the config of the project dir is in, exiting on errors.
+func mustLoadConfig(dir string) *Config {
+	config, err := LoadConfigFrom(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err.Error())
+		os.Exit(-1)
+	}
+
+	return config
+}
+
+func initCmd(config *Config) {
+	if len(flag.Args()) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: cftool init [directory]")
+		os.Exit(-1)
 	}
+
+	dir := flag.Arg(1)
+	err := InitProject(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing project:", err.Error())
+		os.Exit(-1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Initialized cftool project in %s\n", dir)
 }
 
 func processCmd(config *Config) {
-	templatePath := flag.Arg(1)
+	flags := flag.NewFlagSet("process", flag.ExitOnError)
+	strictSecrets := flags.Bool("strict-secrets", false, "Fail instead of warning when vault values are inlined unsafely.")
+	secretsAsParameters := flags.Bool("secrets-as-parameters", false, "Pass vault values as generated NoEcho parameters.")
+	parametersFile := flags.String("parameters-file", "", "Where to write vault parameter values. Required with --secrets-as-parameters.")
+	environment := flags.String("env", "", "The environment to process the template for.")
+	stack := flags.String("stack", "", "The stack to process, for templates that define several.")
+	outputDir := flags.String("output-dir", "", "Write every stack of the template to [name].json in this directory.")
+	keepMetadata := flags.Bool("keep-metadata", false, "Keep CFToolMetadata sections in the output, for debugging.")
+	args := parseCommandFlags(flags, flag.Args()[1:])
+
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cftool process [--env name] [--stack name | --output-dir dir] [--keep-metadata] [--strict-secrets] [--secrets-as-parameters --parameters-file path] [template]")
+		os.Exit(-1)
+	}
+
+	// The parameters file holds plaintext secrets, so it's never put next to
+	// the template where it could be committed by accident.
+	if *secretsAsParameters && *parametersFile == "" {
+		fmt.Fprintln(os.Stderr, "--secrets-as-parameters needs --parameters-file to say where to write vault values.")
+		os.Exit(-1)
+	}
+
+	templatePath := args[0]
+	config = mustLoadConfig(filepath.Dir(templatePath))
+	err := config.SetEnvironment(*environment)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err.Error())
+		os.Exit(-1)
+	}
+
+	options := processOptions{
+		StrictSecrets:       *strictSecrets,
+		SecretsAsParameters: *secretsAsParameters,
+		ParametersFile:      *parametersFile,
+		KeepMetadata:        *keepMetadata,
+	}
+
+	if *outputDir == "" {
+		fmt.Println(processTemplate(config, templatePath, *stack, options))
+		return
+	}
+
+	stacks, err := TemplateStacks(templatePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "An error occurred while processing the template: ", err.Error())
+		os.Exit(-1)
+	}
+	if *stack != "" {
+		stacks = []string{*stack}
+	}
+
+	outputs := map[string]string{}
+	if len(stacks) == 0 {
+		name := strings.TrimSuffix(filepath.Base(templatePath), filepath.Ext(templatePath))
+		outputs[name] = processTemplate(config, templatePath, "", options)
+	}
+	for _, name := range stacks {
+		stackOptions := options
+		if len(stacks) > 1 && options.ParametersFile != "" {
+			ext := filepath.Ext(options.ParametersFile)
+			stackOptions.ParametersFile = strings.TrimSuffix(options.ParametersFile, ext) + "." + name + ext
+		}
+		outputs[name] = processTemplate(config, templatePath, name, stackOptions)
+	}
+
+	err = os.MkdirAll(*outputDir, 0755)
+	if err == nil {
+		for name, output := range outputs {
+			err = writeFileAtomic(filepath.Join(*outputDir, name+".json"), []byte(output+"\n"), 0644)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing output:", err.Error())
+		os.Exit(-1)
+	}
+}
+
+type processOptions struct {
+	StrictSecrets       bool
+	SecretsAsParameters bool
+	ParametersFile      string
+	KeepMetadata        bool
+}
+
+// processTemplate processes one stack of a template and returns its JSON,
+// exiting on errors.
+func processTemplate(config *Config, templatePath string, stack string, options processOptions) string {
 	template := NewTemplate(config)
+	template.Stack = stack
+	template.SecretsAsParameters = options.SecretsAsParameters
+	template.KeepMetadata = options.KeepMetadata
 	err := template.LoadFile(templatePath)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "An error occurred while processing the template: ", err.Error())
 		os.Exit(-1)
 	}
 
-	fmt.Println(template.ToJSON())
+	leaks := template.SecretLeaks()
+	for _, leak := range leaks {
+		fmt.Fprintf(os.Stderr, "Warning: %s is inlined into %s, where it will be visible in the template.\n", leak.Source, leak.Path)
+	}
+	if len(leaks) > 0 && options.StrictSecrets {
+		fmt.Fprintln(os.Stderr, "Refusing to output a template containing secrets (--strict-secrets).")
+		os.Exit(-1)
+	}
+
+	if len(template.SecretParameters()) > 0 {
+		parameters, _ := json.MarshalIndent(template.SecretParameters(), "", "  ")
+		err = writeFileAtomic(options.ParametersFile, append(parameters, '\n'), 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing parameters file:", err.Error())
+			os.Exit(-1)
+		}
+	}
+
+	return template.ToJSON()
 }
 
 func vaultCmd(config *Config) {
@@ -48,6 +196,22 @@ func vaultCmd(config *Config) {
 		vaultEncryptCmd(config)
 	} else if command == "decrypt" {
 		vaultDecryptCmd(config)
+	} else if command == "edit" {
+		vaultEditCmd(config)
+	} else if command == "encrypt-string" {
+		vaultEncryptStringCmd(config)
+	} else if command == "recipients" {
+		vaultRecipientsCmd(config)
+	} else if command == "diff" {
+		vaultDiffCmd(config)
+	} else if command == "get" {
+		vaultGetCmd(config)
+	} else if command == "set" {
+		vaultSetCmd(config)
+	} else if command == "unset" {
+		vaultUnsetCmd(config)
+	} else if command == "list" {
+		vaultListCmd(config)
 	} else {
 		fmt.Println("Vault Usage:")
 		fmt.Println()
@@ -55,18 +219,67 @@ func vaultCmd(config *Config) {
 		fmt.Println()
 		fmt.Println("Available Commands:")
 		fmt.Println()
-		fmt.Println("\tencrypt - Encrypt a vault file.")
-		fmt.Println("\tdecrypt - Decrypt a vault file.")
-		fmt.Println("\tkeygen - Generate a key.")
+		fmt.Println("\tencrypt - Encrypt a vault file. Use -o or --in-place to write a file.")
+		fmt.Println("\tdecrypt - Decrypt a vault file. Use -o or --in-place to write a file.")
+		fmt.Println("\tencrypt-string - Encrypt a single value for use with !encrypted.")
+		fmt.Println("\tedit - Edit a vault file in $EDITOR and encrypt it in place.")
+		fmt.Println("\tdiff - Compare two vault files by key path. Use --textconv for git diffs.")
+		fmt.Println("\tget - Print a single vault value, e.g. Db.Password.")
+		fmt.Println("\tset - Set a vault value from an argument, --stdin or a prompt.")
+		fmt.Println("\tunset - Remove a vault value.")
+		fmt.Println("\tlist - List the paths of vault values without revealing them.")
+		fmt.Println("\tkeygen - Generate a key. Use --passphrase, --kms or --local-kms for other key providers,")
+		fmt.Println("\t         or --identity to generate a recipient identity.")
+		fmt.Println("\trecipients - List, add or remove the recipients of a vault.")
 		fmt.Println()
 	}
 }
 
 func vaultKeygenCommand(config *Config) {
+	flags := flag.NewFlagSet("vault keygen", flag.ExitOnError)
+	passphrase := flags.Bool("passphrase", false, "Derive vault keys from a passphrase instead of generating one.")
+	kmsKeyID := flags.String("kms", "", "Wrap vault data keys with this AWS KMS key ID or alias.")
+	localKMSKeyID := flags.String("local-kms", "", "Wrap vault data keys with a key from the local KMS file, creating it if needed.")
+	identity := flags.Bool("identity", false, "Generate a recipient identity for multi-recipient vaults.")
+	parseCommandFlags(flags, flag.Args()[2:])
+
+	if *identity {
+		generated, err := GenerateIdentity()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error generating identity:", err.Error())
+			os.Exit(-1)
+		}
+
+		fmt.Fprintln(os.Stderr, "Public key:", generated.PublicKey())
+		fmt.Print(generated.String())
+		return
+	}
+
+	if *passphrase {
+		fmt.Println(PassphraseVaultKey)
+		return
+	}
+
+	if *kmsKeyID != "" {
+		fmt.Println(KMSVaultKeyPrefix + *kmsKeyID)
+		return
+	}
+
+	if *localKMSKeyID != "" {
+		err := config.LocalKMS().CreateKey(*localKMSKeyID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating local KMS key:", err.Error())
+			os.Exit(-1)
+		}
+
+		fmt.Println(LocalKMSVaultKeyPrefix + *localKMSKeyID)
+		return
+	}
+
 	key, err := GenerateKey()
 
 	if err != nil {
-		fmt.Println("Error generating key:", err.Error())
+		fmt.Fprintln(os.Stderr, "Error generating key:", err.Error())
 		os.Exit(-1)
 	}
 
@@ -74,51 +287,380 @@ func vaultKeygenCommand(config *Config) {
 }
 
 func vaultEncryptCmd(config *Config) {
-	if config.VaultKey == nil {
-		fmt.Println("Error loading vault key")
+	flags := flag.NewFlagSet("vault encrypt", flag.ExitOnError)
+	output := flags.String("o", "", "Write the encrypted vault to this file instead of stdout.")
+	inPlace := flags.Bool("in-place", false, "Replace the source file with the encrypted vault.")
+	name := flags.String("name", "", "Bind the vault to this name. Defaults to the output path, or the configured vault's name when writing to stdout.")
+	var recipients stringList
+	flags.Var(&recipients, "recipient", "Encrypt for this public key instead of the configured key. May be repeated.")
+	args := parseCommandFlags(flags, flag.Args()[2:])
+
+	if config.VaultKey == nil && config.KeyProvider == nil && !config.VaultPassphrase && len(recipients) == 0 {
+		fmt.Fprintln(os.Stderr, "Error loading vault key")
 		os.Exit(-1)
 	}
 
-	source := flag.Arg(2)
-	if source == "" {
-		fmt.Println("Usage: cftool vault encrypt [encryptionSource]")
-		fmt.Println()
+	if len(args) != 1 || (*inPlace && *output != "") {
+		fmt.Fprintln(os.Stderr, "Usage: cftool vault encrypt [-o output|--in-place] [--name name] [--recipient key]... [encryptionSource]")
 		os.Exit(-1)
 	}
+	source := args[0]
 
 	message, err := ioutil.ReadFile(source)
 	if err != nil {
-		fmt.Println("Error reading encryption source", source, ":", err.Error())
-		fmt.Println()
+		fmt.Fprintln(os.Stderr, "Error reading encryption source", source, ":", err.Error())
+		os.Exit(-1)
+	}
+
+	if *name == "" {
+		switch {
+		case *inPlace:
+			*name = config.vaultNameFor(source)
+		case *output != "":
+			*name = config.vaultNameFor(*output)
+		default:
+			*name = config.expectedVaultName()
+		}
+	}
+
+	encrypted, err := config.EncryptVault(message, VaultOptions{Name: *name, Recipients: recipients})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error encrypting", source, ":", err.Error())
 		os.Exit(-1)
 	}
 
-	fmt.Println(Encrypt(string(message), config.VaultKey))
+	if !strings.HasSuffix(encrypted, "\n") {
+		encrypted += "\n"
+	}
+
+	err = writeOutput(source, *output, *inPlace, []byte(encrypted), 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing encrypted vault:", err.Error())
+		os.Exit(-1)
+	}
 }
 
 func vaultDecryptCmd(config *Config) {
+	flags := flag.NewFlagSet("vault decrypt", flag.ExitOnError)
+	output := flags.String("o", "", "Write the decrypted vault to this file instead of stdout.")
+	inPlace := flags.Bool("in-place", false, "Replace the encrypted file with its plaintext.")
+	name := flags.String("name", "", "The name the vault must be bound to. Defaults to its path.")
+	allowUnbound := flags.Bool("allow-unbound", false, "Accept a vault that isn't bound to a name, e.g. to re-encrypt it with one.")
+	args := parseCommandFlags(flags, flag.Args()[2:])
+
+	if len(args) != 1 || (*inPlace && *output != "") {
+		fmt.Fprintln(os.Stderr, "Usage: cftool vault decrypt [-o output|--in-place] [--name name] [--allow-unbound] [encryptedFile]")
+		os.Exit(-1)
+	}
+	source := args[0]
+
+	message, err := ioutil.ReadFile(source)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading encrypted file", source, ":", err.Error())
+		os.Exit(-1)
+	}
+
+	if *name == "" {
+		*name = config.vaultNameFor(source)
+	}
+
+	header, _, err := ParseVault(message)
+	if err == nil && *allowUnbound && (header == nil || header.Name == "") {
+		*name = ""
+	}
+
+	decrypted, err := config.DecryptVault(message, *name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error decrypting", source, ":", err.Error())
+		os.Exit(-1)
+	}
+
+	err = writeOutput(source, *output, *inPlace, decrypted, 0600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing decrypted vault:", err.Error())
+		os.Exit(-1)
+	}
+}
+
+// Writes a command's result to stdout, an output file or back over its
+// source. Files are replaced atomically so a failure never leaves them
+// half written.
+func writeOutput(source string, output string, inPlace bool, data []byte, perm os.FileMode) error {
+	if inPlace {
+		output = source
+	}
+
+	if output == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	return writeFileAtomic(output, data, perm)
+}
+
+func vaultEncryptStringCmd(config *Config) {
+	flags := flag.NewFlagSet("vault encrypt-string", flag.ExitOnError)
+	stdin := flags.Bool("stdin", false, "Read the value from stdin.")
+	args := parseCommandFlags(flags, flag.Args()[2:])
 
 	if config.VaultKey == nil {
-		fmt.Println("Error opening .vaultkey: ")
-		fmt.Println()
+		fmt.Fprintln(os.Stderr, "Error loading vault key: encrypt-string requires a .vaultkey key")
 		os.Exit(-1)
 	}
 
-	source := flag.Arg(2)
-	if source == "" {
-		fmt.Println("Usage: cftool vault decrypt [encryptedFile]")
-		fmt.Println()
+	if len(args) > 1 || (*stdin && len(args) != 0) {
+		fmt.Fprintln(os.Stderr, "Usage: cftool vault encrypt-string [value|--stdin]")
 		os.Exit(-1)
 	}
 
-	message, err := ioutil.ReadFile(source)
+	value, err := readValue(args, *stdin, "Value: ")
 	if err != nil {
-		fmt.Println("Error reading encrypted file", source, ":", err.Error())
-		fmt.Println()
+		fmt.Fprintln(os.Stderr, "Error reading value:", err.Error())
+		os.Exit(-1)
+	}
+
+	fmt.Println("!encrypted", Encrypt(value, config.VaultKey))
+}
+
+func vaultRecipientsCmd(config *Config) {
+	flags := flag.NewFlagSet("vault recipients", flag.ExitOnError)
+	rotate := flags.Bool("rotate", false, "When removing, re-encrypt the vault with a new data key.")
+	args := parseCommandFlags(flags, flag.Args()[2:])
+
+	if len(args) == 0 || ((args[0] == "add" || args[0] == "remove") && len(args) < 2) {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "\tcftool vault recipients list [vault]")
+		fmt.Fprintln(os.Stderr, "\tcftool vault recipients add [publicKey] [vault]")
+		fmt.Fprintln(os.Stderr, "\tcftool vault recipients remove [--rotate] [publicKey] [vault]")
+		os.Exit(-1)
+	}
+
+	command := args[0]
+	var publicKey string
+	if command == "add" || command == "remove" {
+		publicKey = args[1]
+		args = args[1:]
+	}
+
+	path := config.projectPath(config.VaultPath)
+	if len(args) > 1 {
+		path = args[1]
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading vault", path, ":", err.Error())
 		os.Exit(-1)
 	}
 
-	fmt.Println(Decrypt(string(message), config.VaultKey))
+	var updated string
+	switch command {
+	case "list":
+		header, _, err := ParseVault(data)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading vault", path, ":", err.Error())
+			os.Exit(-1)
+		}
+
+		for _, recipient := range header.Options().Recipients {
+			fmt.Println(recipient)
+		}
+		return
+
+	case "add":
+		updated, err = AddVaultRecipient(config, data, publicKey)
+
+	case "remove":
+		updated, err = RemoveVaultRecipient(data, publicKey)
+		if err == nil && *rotate {
+			updated, err = RotateVault(config, []byte(updated))
+		}
+
+	default:
+		err = fmt.Errorf("Unknown recipients command: %s", command)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error updating recipients of", path, ":", err.Error())
+		os.Exit(-1)
+	}
+
+	err = writeFileAtomic(path, []byte(updated), 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing vault", path, ":", err.Error())
+		os.Exit(-1)
+	}
+}
+
+func vaultDiffCmd(config *Config) {
+	flags := flag.NewFlagSet("vault diff", flag.ExitOnError)
+	showValues := flags.Bool("show-values", false, "Show values instead of masking them.")
+	textconv := flags.Bool("textconv", false, "Print a single vault as path: value lines for git's textconv.")
+	args := parseCommandFlags(flags, flag.Args()[2:])
+
+	if (*textconv && len(args) != 1) || (!*textconv && len(args) != 2) {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "\tcftool vault diff [--show-values] [oldVault] [newVault]")
+		fmt.Fprintln(os.Stderr, "\tcftool vault diff --textconv [--show-values] [vault]")
+		os.Exit(-1)
+	}
+
+	var vaults []*yamlast.Node
+	for _, path := range args {
+		vault, err := ReadVaultFile(config, path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading vault", path, ":", err.Error())
+			os.Exit(-1)
+		}
+		vaults = append(vaults, vault)
+	}
+
+	var lines []string
+	if *textconv {
+		lines = TextconvVault(vaults[0], *showValues, config.VaultKey)
+	} else {
+		lines = DiffVaults(vaults[0], vaults[1], *showValues)
+	}
+
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+func vaultEditCmd(config *Config) {
+	flags := flag.NewFlagSet("vault edit", flag.ExitOnError)
+	name := flags.String("name", "", "The name the vault must be bound to. Defaults to its path.")
+	args := parseCommandFlags(flags, flag.Args()[2:])
+
+	path := config.projectPath(config.VaultPath)
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	if *name == "" {
+		*name = config.vaultNameFor(path)
+	}
+
+	err := EditVault(config, path, *name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error editing vault", path, ":", err.Error())
+		os.Exit(-1)
+	}
+}
+
+func vaultGetCmd(config *Config) {
+	selector := flag.Arg(2)
+	if selector == "" {
+		fmt.Fprintln(os.Stderr, "Usage: cftool vault get [selector]")
+		os.Exit(-1)
+	}
+
+	node, err := GetVaultValue(config, selector)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading vault:", err.Error())
+		os.Exit(-1)
+	}
+
+	if node.Kind == yamlast.ScalarNode {
+		fmt.Println(node.Value)
+	} else {
+		os.Stdout.Write(FormatYAML(node))
+	}
+}
+
+func vaultSetCmd(config *Config) {
+	flags := flag.NewFlagSet("vault set", flag.ExitOnError)
+	stdin := flags.Bool("stdin", false, "Read the value from stdin.")
+	args := parseCommandFlags(flags, flag.Args()[2:])
+
+	if len(args) < 1 || len(args) > 2 || (*stdin && len(args) != 1) {
+		fmt.Fprintln(os.Stderr, "Usage: cftool vault set [selector] [value|--stdin]")
+		os.Exit(-1)
+	}
+
+	value, err := readValue(args[1:], *stdin, args[0]+": ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading value:", err.Error())
+		os.Exit(-1)
+	}
+
+	err = SetVaultValue(config, args[0], value)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error setting vault value:", err.Error())
+		os.Exit(-1)
+	}
+}
+
+func vaultUnsetCmd(config *Config) {
+	selector := flag.Arg(2)
+	if selector == "" {
+		fmt.Fprintln(os.Stderr, "Usage: cftool vault unset [selector]")
+		os.Exit(-1)
+	}
+
+	err := UnsetVaultValue(config, selector)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error removing vault value:", err.Error())
+		os.Exit(-1)
+	}
+}
+
+func vaultListCmd(config *Config) {
+	err := config.LoadVault()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading vault:", err.Error())
+		os.Exit(-1)
+	}
+
+	for _, path := range VaultPaths(config.VaultAST) {
+		fmt.Println(path)
+	}
+}
+
+// Reads a secret value from the command line, stdin or an interactive prompt.
+func readValue(args []string, stdin bool, prompt string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+
+	if stdin {
+		input, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(input), "\n"), "\r"), nil
+	}
+
+	input, err := PromptSecret(prompt, true)
+	return string(input), err
+}
+
+// A flag that may be given several times.
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// Parses flags for a subcommand, allowing them to appear before, after or
+// between positional arguments. Returns the positional arguments.
+func parseCommandFlags(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
 }
 
 // Prints generic usage for the entire app
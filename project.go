@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultConfigYAML is written to config.yml by cftool init. It spells out the
+// default settings so they're easy to find and change.
+const defaultConfigYAML = `---
+# Where !import and !file look for files, relative to this file.
+Imports: imports
+Files: files
+
+# The encrypted vault read by !vault and cftool vault. Name binds the vault
+# to a name other than its path.
+Vault:
+  Path: vault
+
+# The AWS region used when a template or environment doesn't choose one.
+Region: us-east-1
+
+# Environments templates can be processed for. Each one can override any of
+# the settings above.
+Environments:
+  staging:
+  prod:
+
+# Where !lambda-zip writes zips, and the S3 bucket and key prefix they're
+# uploaded to.
+Artifacts:
+  Path: artifacts
+  # Bucket: my-artifacts-bucket
+  # Prefix: lambda/
+
+# Environment variables templates may read with !envvar.
+EnvVars: []
+
+# How cftool process formats the generated JSON.
+Output:
+  Indent: 2
+  Compact: false
+`
+
+// InitProject scaffolds a cftool project in dir, creating the directory if
+// needed. It refuses to overwrite the config of an existing project.
+func InitProject(dir string) error {
+	for _, sub := range []string{dir, filepath.Join(dir, defaultImportsPath), filepath.Join(dir, defaultFilesPath)} {
+		err := os.MkdirAll(sub, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	configPath := filepath.Join(dir, ConfigFile)
+	_, err := os.Stat(configPath)
+	if err == nil {
+		return fmt.Errorf("%s already exists", configPath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return ioutil.WriteFile(configPath, []byte(defaultConfigYAML), 0644)
+}
+
+// FindProjectRoot walks up from dir looking for a directory with a config.yml
+// or .vaultkey in it. dir itself is the root when none is found. A root inside
+// the current directory is returned as a relative path.
+func FindProjectRoot(dir string) string {
+	start, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+
+	for current := start; ; current = filepath.Dir(current) {
+		for _, marker := range []string{ConfigFile, VaultKeyFile} {
+			_, err := os.Stat(filepath.Join(current, marker))
+			if err == nil {
+				return relativeToWorkingDir(current)
+			}
+		}
+
+		if filepath.Dir(current) == current {
+			return relativeToWorkingDir(start)
+		}
+	}
+}
+
+func relativeToWorkingDir(path string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+
+	// Paths leading out of the working directory are left absolute, since ..
+	// doesn't lead back the same way through a symlinked directory.
+	rel, err := filepath.Rel(wd, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+
+	return rel
+}
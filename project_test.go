@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+func TestInitProject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	project := filepath.Join(dir, "demo")
+	err = InitProject(project)
+	assert.Nil(t, err)
+
+	for _, sub := range []string{"imports", "files"} {
+		info, err := os.Stat(filepath.Join(project, sub))
+		assert.Nil(t, err)
+		assert.True(t, info.IsDir())
+	}
+
+	config := &Config{}
+	err = config.LoadConfigFile(filepath.Join(project, ConfigFile))
+	assert.Nil(t, err)
+	assert.Equal(t, "imports", config.ImportsPath)
+	assert.Equal(t, "files", config.FilesPath)
+	assert.Equal(t, "vault", config.VaultPath)
+	assert.Equal(t, "us-east-1", config.Region)
+	assert.True(t, config.HasEnvironment("staging"))
+	assert.True(t, config.HasEnvironment("prod"))
+	assert.Equal(t, 2, config.OutputIndent)
+	assert.False(t, config.CompactOutput)
+
+	err = InitProject(project)
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ConfigFile)
+	config := &Config{}
+	assert.Nil(t, config.LoadConfigFile(path))
+
+	err = ioutil.WriteFile(path, []byte{}, 0644)
+	assert.Nil(t, err)
+	assert.Nil(t, config.LoadConfigFile(path))
+
+	err = ioutil.WriteFile(path, []byte("Vault:\n  Path: [a, b]\n"), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, config.LoadConfigFile(path))
+
+	err = ioutil.WriteFile(path, []byte("Output:\n  Indent: wide\n"), 0644)
+	assert.Nil(t, err)
+	assert.NotNil(t, config.LoadConfigFile(path))
+}
+
+func TestFindProjectRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	stacks := filepath.Join(dir, "stacks", "web")
+	assert.Nil(t, os.MkdirAll(stacks, 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ConfigFile), []byte("Files: assets\n"), 0644))
+
+	root, err := filepath.Abs(FindProjectRoot(stacks))
+	assert.Nil(t, err)
+	assert.Equal(t, dir, root)
+
+	config, err := LoadConfigFrom(stacks)
+	assert.Nil(t, err)
+	path, err := filepath.Abs(config.projectPath(filepath.Join(config.FilesPath, "a.txt")))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "assets", "a.txt"), path)
+	assert.Equal(t, "stacks/web/vault", config.relativePath(filepath.Join(stacks, "vault")))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// PromptSecret asks for a passphrase or other secret on stderr and reads it
+// from the terminal with echo turned off. The terminal is read directly, so
+// stdin stays free for input like `vault set --stdin`; stdin is only used when
+// there's no terminal. When confirm is set the secret has to be entered twice.
+func PromptSecret(prompt string, confirm bool) ([]byte, error) {
+	input := os.Stdin
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		defer tty.Close()
+		input = tty
+	}
+	reader := bufio.NewReader(input)
+
+	secret, err := readSecret(input, reader, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	if confirm {
+		again, err := readSecret(input, reader, "Confirm "+strings.ToLower(prompt[:1])+prompt[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if again != secret {
+			return nil, errors.New("Entries do not match")
+		}
+	}
+
+	if secret == "" {
+		return nil, errors.New("Empty entry")
+	}
+
+	return []byte(secret), nil
+}
+
+func readSecret(input *os.File, reader *bufio.Reader, prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+
+	fd := int(input.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := reader.ReadString('\n')
+		fmt.Fprintln(os.Stderr)
+		if err != nil && line == "" {
+			return "", fmt.Errorf("Error reading input: %s", err)
+		}
+
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	// Echo has to come back on if we're interrupted while it's off.
+	state, err := term.GetState(fd)
+	if err != nil {
+		return "", fmt.Errorf("Error reading input: %s", err)
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		if _, ok := <-interrupts; ok {
+			term.Restore(fd, state)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(-1)
+		}
+	}()
+	defer func() {
+		signal.Stop(interrupts)
+		close(interrupts)
+	}()
+
+	secret, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("Error reading input: %s", err)
+	}
+
+	return string(secret), nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// PublicKeyPrefix starts every recipient public key.
+	PublicKeyPrefix = "cftool1"
+
+	// SecretKeyPrefix starts the secret key line of an identity file.
+	SecretKeyPrefix = "CFTOOL-SECRET-KEY-"
+
+	recipientWrapInfo = "cftool vault recipient"
+)
+
+// Recipient is a data key wrapped for one recipient's X25519 public key.
+type Recipient struct {
+	PublicKey    string
+	EphemeralKey []byte
+	WrappedKey   []byte
+}
+
+// Identity is an X25519 key pair that can unwrap data keys wrapped for its
+// public key.
+type Identity struct {
+	privateKey *ecdh.PrivateKey
+}
+
+// GenerateIdentity creates a new random identity.
+func GenerateIdentity() (*Identity, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{privateKey: privateKey}, nil
+}
+
+// ParseIdentity reads an identity file's contents. Blank lines and lines
+// starting with # are ignored.
+func ParseIdentity(data []byte) (*Identity, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !strings.HasPrefix(line, SecretKeyPrefix) {
+			return nil, errors.New("Invalid identity file")
+		}
+
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(line, SecretKeyPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid identity: %s", err)
+		}
+
+		privateKey, err := ecdh.X25519().NewPrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid identity: %s", err)
+		}
+
+		return &Identity{privateKey: privateKey}, nil
+	}
+
+	return nil, errors.New("No identity found")
+}
+
+// LoadIdentity loads the identity in $CFTOOL_IDENTITY, or
+// ~/.cftool/identity by default.
+func LoadIdentity() (*Identity, error) {
+	path := identityPath()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading identity %s: %s", path, err)
+	}
+
+	return ParseIdentity(data)
+}
+
+func identityPath() string {
+	if path := os.Getenv("CFTOOL_IDENTITY"); path != "" {
+		return path
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".cftool", "identity")
+}
+
+// PublicKey returns the identity's public key in recipient form.
+func (identity *Identity) PublicKey() string {
+	return PublicKeyPrefix + base64.RawURLEncoding.EncodeToString(identity.privateKey.PublicKey().Bytes())
+}
+
+// String returns the identity in the form written to identity files.
+func (identity *Identity) String() string {
+	return fmt.Sprintf("# public key: %s\n%s%s\n", identity.PublicKey(),
+		SecretKeyPrefix, base64.RawURLEncoding.EncodeToString(identity.privateKey.Bytes()))
+}
+
+// Unwrap recovers the data key from the recipient stanza for this identity.
+func (identity *Identity) Unwrap(recipients []Recipient) ([]byte, error) {
+	publicKey := identity.PublicKey()
+	for _, recipient := range recipients {
+		if recipient.PublicKey != publicKey {
+			continue
+		}
+
+		ephemeralKey, err := ecdh.X25519().NewPublicKey(recipient.EphemeralKey)
+		if err != nil {
+			return nil, err
+		}
+
+		shared, err := identity.privateKey.ECDH(ephemeralKey)
+		if err != nil {
+			return nil, err
+		}
+
+		wrapKey, err := recipientWrapKey(shared, recipient.EphemeralKey, identity.privateKey.PublicKey().Bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		return decrypt(base64.StdEncoding.EncodeToString(recipient.WrappedKey), wrapKey, nil)
+	}
+
+	return nil, fmt.Errorf("%s is not a recipient of this vault", publicKey)
+}
+
+// WrapForRecipient wraps a data key for a recipient's public key using an
+// ephemeral X25519 key agreement.
+func WrapForRecipient(dataKey []byte, publicKey string) (Recipient, error) {
+	if !strings.HasPrefix(publicKey, PublicKeyPrefix) {
+		return Recipient{}, fmt.Errorf("Invalid recipient public key: %s", publicKey)
+	}
+
+	keyBytes, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(publicKey, PublicKeyPrefix))
+	if err != nil {
+		return Recipient{}, fmt.Errorf("Invalid recipient public key: %s", publicKey)
+	}
+
+	recipientKey, err := ecdh.X25519().NewPublicKey(keyBytes)
+	if err != nil {
+		return Recipient{}, fmt.Errorf("Invalid recipient public key: %s", publicKey)
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Recipient{}, err
+	}
+
+	shared, err := ephemeral.ECDH(recipientKey)
+	if err != nil {
+		return Recipient{}, err
+	}
+
+	ephemeralKey := ephemeral.PublicKey().Bytes()
+	wrapKey, err := recipientWrapKey(shared, ephemeralKey, keyBytes)
+	if err != nil {
+		return Recipient{}, err
+	}
+
+	wrapped, err := encrypt(dataKey, wrapKey, nil)
+	if err != nil {
+		return Recipient{}, err
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return Recipient{}, err
+	}
+
+	return Recipient{PublicKey: publicKey, EphemeralKey: ephemeralKey, WrappedKey: wrappedKey}, nil
+}
+
+// WrapForRecipients wraps a data key for each of the given public keys.
+func WrapForRecipients(dataKey []byte, publicKeys []string) ([]Recipient, error) {
+	var recipients []Recipient
+	for _, publicKey := range publicKeys {
+		recipient, err := WrapForRecipient(dataKey, publicKey)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	return recipients, nil
+}
+
+func recipientWrapKey(shared []byte, ephemeralKey []byte, recipientKey []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeralKey...), recipientKey...)
+	return hkdf.Key(sha256.New, shared, salt, recipientWrapInfo, 32)
+}
+
+// AddVaultRecipient wraps the data key of a recipient vault for another public
+// key. Only the header changes; the encrypted contents stay as they are.
+func AddVaultRecipient(config *Config, data []byte, publicKey string) (string, error) {
+	header, payload, err := ParseVault(data)
+	if err != nil {
+		return "", err
+	}
+
+	if header == nil || len(header.Recipients) == 0 {
+		return "", errors.New("Vault isn't encrypted for recipients")
+	}
+
+	for _, recipient := range header.Recipients {
+		if recipient.PublicKey == publicKey {
+			return "", fmt.Errorf("%s is already a recipient", publicKey)
+		}
+	}
+
+	dataKey, err := config.vaultKey(header)
+	if err != nil {
+		return "", err
+	}
+
+	recipient, err := WrapForRecipient(dataKey, publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	header.Recipients = append(header.Recipients, recipient)
+	return FormatVault(header, payload), nil
+}
+
+// RemoveVaultRecipient drops a recipient from a vault's header. The removed
+// recipient could have kept the data key, so rotate it too if their access
+// needs to be revoked for good.
+func RemoveVaultRecipient(data []byte, publicKey string) (string, error) {
+	header, payload, err := ParseVault(data)
+	if err != nil {
+		return "", err
+	}
+
+	if header == nil || len(header.Recipients) == 0 {
+		return "", errors.New("Vault isn't encrypted for recipients")
+	}
+
+	var remaining []Recipient
+	for _, recipient := range header.Recipients {
+		if recipient.PublicKey != publicKey {
+			remaining = append(remaining, recipient)
+		}
+	}
+
+	if len(remaining) == len(header.Recipients) {
+		return "", fmt.Errorf("%s is not a recipient", publicKey)
+	}
+	if len(remaining) == 0 {
+		return "", errors.New("Can't remove the last recipient of a vault")
+	}
+
+	header.Recipients = remaining
+	return FormatVault(header, payload), nil
+}
+
+// RotateVault re-encrypts a vault with a new data key for the same recipients.
+func RotateVault(config *Config, data []byte) (string, error) {
+	header, _, err := ParseVault(data)
+	if err != nil {
+		return "", err
+	}
+
+	decrypted, err := config.DecryptVault(data, "")
+	if err != nil {
+		return "", err
+	}
+
+	return config.EncryptVault(decrypted, header.Options())
+}
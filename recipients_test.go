@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+func TestVaultRecipients(t *testing.T) {
+	alice, err := GenerateIdentity()
+	assert.Nil(t, err)
+	bob, err := GenerateIdentity()
+	assert.Nil(t, err)
+
+	parsed, err := ParseIdentity([]byte(alice.String()))
+	assert.Nil(t, err)
+	assert.Equal(t, alice.PublicKey(), parsed.PublicKey())
+
+	config := &Config{identity: alice}
+	encrypted, err := config.EncryptVault([]byte("Db: secret"), VaultOptions{Recipients: []string{alice.PublicKey()}})
+	assert.Nil(t, err)
+
+	bobConfig := &Config{identity: bob}
+	_, err = bobConfig.DecryptVault([]byte(encrypted), "")
+	assert.NotNil(t, err)
+
+	added, err := AddVaultRecipient(config, []byte(encrypted), bob.PublicKey())
+	assert.Nil(t, err)
+
+	decrypted, err := bobConfig.DecryptVault([]byte(added), "")
+	assert.Nil(t, err)
+	assert.Equal(t, "Db: secret", string(decrypted))
+
+	removed, err := RemoveVaultRecipient([]byte(added), alice.PublicKey())
+	assert.Nil(t, err)
+
+	_, err = config.DecryptVault([]byte(removed), "")
+	assert.NotNil(t, err)
+	decrypted, err = bobConfig.DecryptVault([]byte(removed), "")
+	assert.Nil(t, err)
+	assert.Equal(t, "Db: secret", string(decrypted))
+
+	_, err = RemoveVaultRecipient([]byte(removed), bob.PublicKey())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/commondream/yamlast"
+)
+
+// Resource properties that exist to hold secrets, so vault values may be
+// inlined into them without a warning.
+var secretSafeProperties = map[string]bool{
+	"AWS::SecretsManager::Secret.SecretString":               true,
+	"AWS::RDS::DBInstance.MasterUserPassword":                true,
+	"AWS::RDS::DBCluster.MasterUserPassword":                 true,
+	"AWS::DocDB::DBCluster.MasterUserPassword":               true,
+	"AWS::Redshift::Cluster.MasterUserPassword":              true,
+	"AWS::ElastiCache::ReplicationGroup.AuthToken":           true,
+	"AWS::DirectoryService::MicrosoftAD.Password":            true,
+	"AWS::DirectoryService::SimpleAD.Password":               true,
+	"AWS::AmazonMQ::Broker.Users":                            true,
+	"AWS::CodePipeline::Webhook.AuthenticationConfiguration": true,
+}
+
+// SecretLeak is a vault value that ended up in the output somewhere other than
+// a NoEcho parameter default or a secret-safe resource property.
+type SecretLeak struct {
+	Path   string
+	Source string
+}
+
+// markSecret records that node holds a secret, so SecretLeaks can find where
+// it ends up.
+func (template *Template) markSecret(node *yamlast.Node, source string) {
+	if template.secretNodes == nil {
+		template.secretNodes = map[*yamlast.Node]string{}
+	}
+
+	template.secretNodes[node] = source
+}
+
+// SecretLeaks returns every place in the output a secret was inlined into
+// that isn't known to be safe for it.
+func (template *Template) SecretLeaks() []SecretLeak {
+	if len(template.secretNodes) == 0 || template.DocumentNode == nil || len(template.DocumentNode.Children) == 0 {
+		return nil
+	}
+
+	root := template.DocumentNode.Children[0]
+	var leaks []SecretLeak
+	var walk func(node *yamlast.Node, parts []selectorPart)
+	walk = func(node *yamlast.Node, parts []selectorPart) {
+		if source, ok := template.secretNodes[node]; ok {
+			if !template.secretSafe(root, parts) {
+				leaks = append(leaks, SecretLeak{Path: formatSelector(parts), Source: source})
+			}
+			return
+		}
+
+		switch node.Kind {
+		case yamlast.MappingNode:
+			for i := 0; i+1 < len(node.Children); i += 2 {
+				path := append(append([]selectorPart{}, parts...), selectorPart{Key: node.Children[i].Value})
+				if !template.KeepMetadata && isMetadataPath(path) {
+					continue
+				}
+				walk(node.Children[i+1], path)
+			}
+
+		case yamlast.SequenceNode:
+			for i, child := range node.Children {
+				walk(child, append(append([]selectorPart{}, parts...), selectorPart{Index: i, IsIndex: true}))
+			}
+		}
+	}
+	walk(root, nil)
+
+	return leaks
+}
+
+// secretSafe reports whether a secret at path stays out of the template body
+// or lands in a property meant for secrets.
+func (template *Template) secretSafe(root *yamlast.Node, parts []selectorPart) bool {
+	if len(parts) == 3 && parts[0].Key == "Parameters" && parts[2].Key == "Default" {
+		noEcho := selectNode(root, formatSelector(append(parts[:2:2], selectorPart{Key: "NoEcho"})))
+		return noEcho != nil && strings.EqualFold(noEcho.Value, "true")
+	}
+
+	if len(parts) >= 4 && parts[0].Key == "Resources" && parts[2].Key == "Properties" {
+		resourceType := selectNode(root, formatSelector(append(parts[:2:2], selectorPart{Key: "Type"})))
+		return resourceType != nil && secretSafeProperties[resourceType.Value+"."+parts[3].Key]
+	}
+
+	return false
+}
+
+// SecretParameter is a generated NoEcho parameter standing in for a vault
+// value, along with the value to pass at deploy time.
+type SecretParameter struct {
+	ParameterKey   string
+	ParameterValue string
+}
+
+var nonAlphanumericRegex = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// vaultParameterName turns a vault selector into a parameter name, like
+// VaultDbPassword for Db.Password.
+func vaultParameterName(selector string) string {
+	name := "Vault"
+	for _, word := range nonAlphanumericRegex.Split(selector, -1) {
+		if word != "" {
+			name += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+
+	return name
+}
+
+// vaultParameterHandler resolves a !vault value into a reference to a NoEcho
+// parameter, remembering the value for the parameters file.
+func (template *Template) vaultParameterHandler(tag string, value string) (*yamlast.Node, error) {
+	node := selectNode(template.Config.VaultAST, value)
+	if node == nil {
+		return nil, fmt.Errorf("Unknown vault value: %s", value)
+	}
+	if node.Kind != yamlast.ScalarNode {
+		return nil, fmt.Errorf("Vault value %s can't be passed as a parameter because it isn't a string", value)
+	}
+
+	name := vaultParameterName(value)
+	known := false
+	for _, parameter := range template.secretParameters {
+		if parameter.ParameterKey == name {
+			if parameter.ParameterValue != node.Value {
+				return nil, fmt.Errorf("Vault values with different contents both map to parameter %s", name)
+			}
+			known = true
+		}
+	}
+
+	if !known {
+		template.secretParameters = append(template.secretParameters,
+			SecretParameter{ParameterKey: name, ParameterValue: node.Value})
+	}
+
+	return template.refHandler("!ref", name)
+}
+
+// addSecretParameters adds a NoEcho parameter to the template for every vault
+// value that was replaced by a reference.
+func (template *Template) addSecretParameters() error {
+	if len(template.secretParameters) == 0 {
+		return nil
+	}
+
+	root := template.DocumentNode.Children[0]
+	if root.Kind != yamlast.MappingNode {
+		return fmt.Errorf("Can't add vault parameters to a template that isn't a mapping")
+	}
+
+	parameters := selectNode(template.DocumentNode, "Parameters")
+	if parameters == nil {
+		parameters = &yamlast.Node{Kind: yamlast.MappingNode}
+		root.Children = append(root.Children,
+			&yamlast.Node{Kind: yamlast.ScalarNode, Value: "Parameters"}, parameters)
+	}
+
+	for _, parameter := range template.secretParameters {
+		if selectNode(parameters, parameter.ParameterKey) != nil {
+			return fmt.Errorf("Parameter %s already exists", parameter.ParameterKey)
+		}
+
+		definition := &yamlast.Node{Kind: yamlast.MappingNode, Children: []*yamlast.Node{
+			{Kind: yamlast.ScalarNode, Value: "Type"},
+			{Kind: yamlast.ScalarNode, Value: "String"},
+			{Kind: yamlast.ScalarNode, Value: "NoEcho"},
+			{Kind: yamlast.ScalarNode, Value: "true"},
+		}}
+		parameters.Children = append(parameters.Children,
+			&yamlast.Node{Kind: yamlast.ScalarNode, Value: parameter.ParameterKey}, definition)
+	}
+
+	return nil
+}
+
+// SecretParameters returns the values of the parameters generated for vault
+// values, in the form `aws cloudformation` accepts as a parameters file.
+func (template *Template) SecretParameters() []SecretParameter {
+	return template.secretParameters
+}
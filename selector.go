@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/commondream/yamlast"
+)
+
+// Matches one part of a yamlast.SelectNode selector: a bare key, a quoted key
+// or a sequence index.
+var selectorPartRegex = regexp.MustCompile(`^(([^\.\"\[\]\s]+)|\"([^\"]*)\"|\[([0-9]+)\])\.?`)
+
+type selectorPart struct {
+	Key     string
+	Index   int
+	IsIndex bool
+}
+
+func (part selectorPart) String() string {
+	if part.IsIndex {
+		return fmt.Sprintf("[%d]", part.Index)
+	}
+	return part.Key
+}
+
+// parseSelector splits a selector into its parts using the same syntax as
+// yamlast.SelectNode.
+func parseSelector(selector string) ([]selectorPart, error) {
+	selector = strings.TrimSpace(selector)
+	if selector == "" {
+		return nil, fmt.Errorf("Empty selector")
+	}
+
+	var parts []selectorPart
+	for index := 0; index < len(selector); {
+		match := selectorPartRegex.FindStringSubmatch(selector[index:])
+		if match == nil {
+			return nil, fmt.Errorf("Invalid selector: %s", selector)
+		}
+
+		switch {
+		case match[2] != "":
+			parts = append(parts, selectorPart{Key: match[2]})
+		case match[4] != "":
+			i, _ := strconv.Atoi(match[4])
+			parts = append(parts, selectorPart{Index: i, IsIndex: true})
+		default:
+			parts = append(parts, selectorPart{Key: match[3]})
+		}
+
+		index += len(match[0])
+	}
+
+	return parts, nil
+}
+
+// formatSelector joins path parts back into a selector, quoting keys that
+// can't be written bare.
+func formatSelector(parts []selectorPart) string {
+	var out string
+	for i, part := range parts {
+		if part.IsIndex {
+			out += part.String()
+			continue
+		}
+
+		if i > 0 {
+			out += "."
+		}
+		if strings.ContainsAny(part.Key, ".\"[] \t\n") || part.Key == "" {
+			out += `"` + part.Key + `"`
+		} else {
+			out += part.Key
+		}
+	}
+
+	return out
+}
+
+// selectNode finds the node described by selector like yamlast.SelectNode,
+// but returns nil when any key along the way is missing instead of stopping at
+// the deepest node found.
+func selectNode(node *yamlast.Node, selector string) *yamlast.Node {
+	parts, err := parseSelector(selector)
+	if err != nil || node == nil {
+		return nil
+	}
+
+	current := node
+	if current.Kind == yamlast.DocumentNode {
+		if len(current.Children) == 0 {
+			return nil
+		}
+		current = current.Children[0]
+	}
+
+	for _, part := range parts {
+		var next *yamlast.Node
+		if part.IsIndex && current.Kind == yamlast.SequenceNode {
+			if part.Index < len(current.Children) {
+				next = current.Children[part.Index]
+			}
+		} else if !part.IsIndex && current.Kind == yamlast.MappingNode {
+			for i := 0; i+1 < len(current.Children); i += 2 {
+				if current.Children[i].Value == part.Key {
+					next = current.Children[i+1]
+					break
+				}
+			}
+		}
+
+		if next == nil {
+			return nil
+		}
+		current = next
+	}
+
+	return current
+}
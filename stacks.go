@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/commondream/yamlast"
+)
+
+// StackKey, in a document's metadata, names the stack the document defines
+// when a template file holds several stacks.
+const StackKey = "Stack"
+
+// TemplateStacks lists the names of the stacks defined by the template file at
+// path, in the order they appear. It's empty when the file is a single
+// template.
+func TemplateStacks(path string) ([]string, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading file %s: %s", path, err)
+	}
+
+	docs, err := parseYAMLDocuments(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return stackNames(docs)
+}
+
+func stackNames(docs []*yamlast.Node) ([]string, error) {
+	var names []string
+	seen := map[string]bool{}
+	for _, doc := range docs {
+		name := documentStack(doc)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Stack %s is defined twice", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// documentStack returns the name of the stack a document defines, if any.
+func documentStack(doc *yamlast.Node) string {
+	node := selectNode(doc, MetadataKey+"."+StackKey)
+	if node == nil || node.Kind != yamlast.ScalarNode {
+		return ""
+	}
+
+	return node.Value
+}
+
+// mergeDocuments combines the documents of a template file into one. Without
+// stacks every document is deep merged in order, so a file can start with a
+// document of metadata followed by the template body. With stacks, the
+// documents that don't name a stack are shared, and are merged with the
+// document of the chosen stack.
+func mergeDocuments(docs []*yamlast.Node, stack string) (*yamlast.Node, error) {
+	names, err := stackNames(docs)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := docs
+	if len(names) == 0 {
+		if stack != "" {
+			return nil, fmt.Errorf("Unknown stack %s: the template doesn't define any stacks", stack)
+		}
+	} else {
+		if stack == "" {
+			return nil, fmt.Errorf("The template defines the stacks %s; choose one with --stack", strings.Join(names, ", "))
+		}
+
+		found := false
+		selected = nil
+		for _, doc := range docs {
+			name := documentStack(doc)
+			if name == "" || name == stack {
+				selected = append(selected, doc)
+			}
+			found = found || name == stack
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown stack %s: the template defines %s", stack, strings.Join(names, ", "))
+		}
+	}
+
+	switch len(selected) {
+	case 0:
+		return &yamlast.Node{Kind: yamlast.DocumentNode, Anchors: map[string]*yamlast.Node{}}, nil
+	case 1:
+		return selected[0], nil
+	}
+
+	merged := &yamlast.Node{Kind: yamlast.DocumentNode, Anchors: map[string]*yamlast.Node{}}
+	for _, doc := range selected {
+		if len(doc.Children) == 0 {
+			continue
+		}
+		if doc.Children[0].Kind != yamlast.MappingNode {
+			return nil, fmt.Errorf("Every document of a multi-document template has to be a mapping")
+		}
+
+		for anchor, node := range doc.Anchors {
+			merged.Anchors[anchor] = node
+		}
+		if len(merged.Children) == 0 {
+			merged.Children = []*yamlast.Node{copyNode(doc.Children[0])}
+		} else {
+			merged.Children[0] = mergeNodes(merged.Children[0], doc.Children[0])
+		}
+	}
+
+	return merged, nil
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/commondream/yamlast"
 )
@@ -17,18 +18,49 @@ const (
 
 type tagHandler func(string, string) (*yamlast.Node, error)
 
+// nodeTagHandler handles tags that need the whole tagged node, like tags on
+// mappings.
+type nodeTagHandler func(*yamlast.Node) (*yamlast.Node, error)
+
+func (template *Template) getNodeTagHandler(tag string) nodeTagHandler {
+	if tag == "!file" || strings.HasPrefix(tag, "!file:") {
+		return template.fileHandler
+	}
+
+	switch tag {
+	case "!tpl":
+		return template.tplHandler
+	default:
+		return nil
+	}
+}
+
 func (template *Template) getTagHandler(tag string) tagHandler {
 	switch tag {
 	case "!import":
 		return template.importTagHandler
 	case "!ref":
 		return template.refHandler
-	case "!file":
-		return template.fileHandler
 	case "!vault":
 		return template.vaultHandler
+	case "!encrypted":
+		return template.encryptedHandler
 	case "!meta":
 		return template.metadataHandler
+	case "!config":
+		return template.configHandler
+	case "!env":
+		return template.envHandler
+	case "!envvar":
+		return template.envVarHandler
+	case "!json":
+		return template.jsonHandler
+	case "!text":
+		return template.textHandler
+	case "!lambda-code":
+		return template.lambdaCodeHandler
+	case "!lambda-zip":
+		return template.lambdaZipHandler
 	default:
 		return nil
 	}
@@ -38,6 +70,22 @@ func (template *Template) getTagHandler(tag string) tagHandler {
 type Template struct {
 	Config       *Config
 	DocumentNode *yamlast.Node
+
+	// KeepMetadata keeps CFToolMetadata sections in the output, for
+	// debugging.
+	KeepMetadata bool
+
+	// Stack chooses which stack to build from a template file that defines
+	// several.
+	Stack string
+
+	// SecretsAsParameters replaces !vault values with references to generated
+	// NoEcho parameters instead of inlining them.
+	SecretsAsParameters bool
+
+	secretNodes      map[*yamlast.Node]string
+	secretParameters []SecretParameter
+	overlay          *yamlast.Node
 }
 
 // NewTemplate initializes and returns a new template.
@@ -58,6 +106,13 @@ func (template *Template) loadFileInternal(path string, isRoot bool) (*yamlast.N
 		return nil, errors.New(fmt.Sprintf("Error reading file %s: %s", path, err))
 	}
 
+	if isRoot && template.Config.Environment != "" {
+		template.overlay, err = loadOverlay(overlayPath(path, template.Config.Environment))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return template.loadSourceInternal(b, isRoot)
 }
 
@@ -67,12 +122,26 @@ func (template *Template) LoadSource(source []byte) error {
 }
 
 func (template *Template) loadSourceInternal(source []byte, isRoot bool) (*yamlast.Node, error) {
-	doc, err := yamlast.Parse(source)
+	var doc *yamlast.Node
+	var err error
+	if isRoot {
+		var docs []*yamlast.Node
+		docs, err = parseYAMLDocuments(source)
+		if err == nil {
+			doc, err = mergeDocuments(docs, template.Stack)
+		}
+	} else {
+		doc, err = parseYAML(source)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	if isRoot {
+		err = template.applyEnvironment(doc)
+		if err != nil {
+			return nil, err
+		}
 		template.DocumentNode = doc
 	}
 
@@ -81,22 +150,95 @@ func (template *Template) loadSourceInternal(source []byte, isRoot bool) (*yamla
 		return nil, err
 	}
 
+	if isRoot {
+		err = checkUniqueKeys(selectNode(doc, "Resources"), "Duplicate resource")
+		if err != nil {
+			return nil, err
+		}
+
+		err = template.addSecretParameters()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return doc, nil
 }
 
+// applyEnvironment deep merges the active environment's overrides over the
+// document: first the environment's section under Environments in the
+// metadata, then the environment's overlay file.
+func (template *Template) applyEnvironment(doc *yamlast.Node) error {
+	environment := template.Config.Environment
+	if environment == "" || len(doc.Children) == 0 {
+		return nil
+	}
+
+	section := selectNode(doc, formatSelector([]selectorPart{{Key: MetadataKey}, {Key: "Environments"}, {Key: environment}}))
+	if section == nil && template.overlay == nil && !template.Config.HasEnvironment(environment) {
+		return fmt.Errorf("Unknown environment: %s", environment)
+	}
+
+	for _, overlay := range []*yamlast.Node{section, template.overlay} {
+		if overlay == nil || overlay.Kind != yamlast.MappingNode {
+			continue
+		}
+		doc.Children[0] = mergeNodes(doc.Children[0], overlay)
+	}
+
+	return nil
+}
+
+// overlayPath returns the path of a template's overlay file for an
+// environment, like web.prod.yml for web.yml.
+func overlayPath(path string, environment string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + environment + ext
+}
+
+// loadOverlay parses the overlay file at path, returning nil when there's no
+// such file.
+func loadOverlay(path string) (*yamlast.Node, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading file %s: %s", path, err)
+	}
+
+	doc, err := parseYAML(b)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+	if len(doc.Children) == 0 {
+		return nil, nil
+	}
+	if doc.Children[0].Kind != yamlast.MappingNode {
+		return nil, fmt.Errorf("Error parsing %s: expected a mapping", path)
+	}
+
+	return doc.Children[0], nil
+}
+
 func (template *Template) processTree(node *yamlast.Node) error {
+	err := template.expandBuildTags(node)
+	if err != nil {
+		return err
+	}
+
 	for index, child := range node.Children {
 		if child.Tag != "" {
-			handler := template.getTagHandler(child.Tag)
-			if handler != nil {
-				var err error
+			var err error
+			if nodeHandler := template.getNodeTagHandler(child.Tag); nodeHandler != nil {
+				node.Children[index], err = nodeHandler(child)
+			} else if handler := template.getTagHandler(child.Tag); handler != nil {
 				node.Children[index], err = handler(child.Tag, child.Value)
-				if err != nil {
-					return err
-				}
 			} else {
 				return fmt.Errorf("Unknown tag: %s", child.Tag)
 			}
+			if err != nil {
+				return err
+			}
 		}
 
 		err := template.processTree(child)
@@ -108,13 +250,57 @@ func (template *Template) processTree(node *yamlast.Node) error {
 	return nil
 }
 
+// expandBuildTags expands the loops and conditionals among node's children.
+// Either can produce more of the other, so they're expanded until none are
+// left.
+func (template *Template) expandBuildTags(node *yamlast.Node) error {
+	for {
+		expandedLoops, err := template.expandLoops(node)
+		if err != nil {
+			return err
+		}
+
+		expandedConditionals, err := template.expandConditionals(node)
+		if err != nil {
+			return err
+		}
+
+		if !expandedLoops && !expandedConditionals {
+			return nil
+		}
+	}
+}
+
+// resolveNode returns a processed copy of node, with its tags resolved.
+func (template *Template) resolveNode(node *yamlast.Node) (*yamlast.Node, error) {
+	wrapper := &yamlast.Node{Kind: yamlast.SequenceNode, Children: []*yamlast.Node{copyNode(node)}}
+	err := template.processTree(wrapper)
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapper.Children[0], nil
+}
+
 func (template *Template) importTagHandler(tag string, value string) (*yamlast.Node, error) {
-	subDoc, err := template.loadFileInternal(fmt.Sprintf("./imports/%s.yml", value), false)
+	subDoc, err := template.loadFileInternal(template.Config.projectPath(filepath.Join(template.Config.ImportsPath, value+".yml")), false)
 	if err != nil {
 		return nil, err
 	}
 
-	return subDoc.Children[0], nil
+	// An imported document's own metadata is build-time only, like the
+	// template's.
+	imported := subDoc.Children[0]
+	if imported.Kind == yamlast.MappingNode && !template.KeepMetadata {
+		for i := 0; i+1 < len(imported.Children); i += 2 {
+			if imported.Children[i].Value == MetadataKey {
+				imported.Children = append(imported.Children[:i], imported.Children[i+2:]...)
+				break
+			}
+		}
+	}
+
+	return imported, nil
 }
 
 func (template *Template) refHandler(tag string, value string) (*yamlast.Node, error) {
@@ -127,43 +313,16 @@ func (template *Template) refHandler(tag string, value string) (*yamlast.Node, e
 	return &refNode, nil
 }
 
-func (template *Template) fileHandler(tag string, value string) (*yamlast.Node, error) {
-	path := fmt.Sprintf("./files/%s", value)
-	file, err := os.Open(path)
+func (template *Template) vaultHandler(tag string, value string) (*yamlast.Node, error) {
+	err := template.Config.LoadVault()
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Error loading file %s: %s", path, err.Error()))
-	}
-	defer file.Close()
-
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text()+"\n")
-	}
-	if scanner.Err() != nil {
-		return nil, errors.New(fmt.Sprintf("Error reading file %s: %s", path, scanner.Err().Error()))
+		return nil, err
 	}
 
-	fileNode := yamlast.Node{Kind: yamlast.SequenceNode}
-	for _, line := range lines {
-		fileNode.Children = append(fileNode.Children,
-			&yamlast.Node{Kind: yamlast.ScalarNode, Value: line})
+	if template.SecretsAsParameters {
+		return template.vaultParameterHandler(tag, value)
 	}
 
-	joinArgs := yamlast.Node{Kind: yamlast.SequenceNode}
-	joinArgs.Children = append(joinArgs.Children,
-		&yamlast.Node{Kind: yamlast.ScalarNode, Value: ""},
-		&fileNode)
-
-	join := yamlast.Node{Kind: yamlast.MappingNode}
-	join.Children = append(join.Children,
-		&yamlast.Node{Kind: yamlast.ScalarNode, Value: "Fn::Join"},
-		&joinArgs)
-
-	return &join, nil
-}
-
-func (template *Template) vaultHandler(tag string, value string) (*yamlast.Node, error) {
 	if template.Config.VaultAST == nil {
 		return &yamlast.Node{Kind: yamlast.ScalarNode, Value: ""}, nil
 	}
@@ -172,24 +331,29 @@ func (template *Template) vaultHandler(tag string, value string) (*yamlast.Node,
 
 	if node == nil {
 		node = &yamlast.Node{Kind: yamlast.ScalarNode, Value: ""}
+	} else {
+		template.markSecret(node, tag+" "+value)
 	}
 	return node, nil
 }
 
-func (template *Template) metadataNode() *yamlast.Node {
-	topMap := template.DocumentNode.Children[0]
-
-	if topMap.Kind != yamlast.MappingNode {
-		return nil
+func (template *Template) encryptedHandler(tag string, value string) (*yamlast.Node, error) {
+	if template.Config.VaultKey == nil {
+		return nil, errors.New("A .vaultkey key is required to decrypt !encrypted values")
 	}
 
-	for i := 0; i < len(topMap.Children)/2; i++ {
-		if topMap.Children[i].Value == MetadataKey {
-			return topMap.Children[i+1]
-		}
+	decrypted, err := decrypt(value, template.Config.VaultKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt !encrypted value: %s", err)
 	}
 
-	return nil
+	node := &yamlast.Node{Kind: yamlast.ScalarNode, Value: string(decrypted)}
+	template.markSecret(node, tag)
+	return node, nil
+}
+
+func (template *Template) metadataNode() *yamlast.Node {
+	return selectNode(template.DocumentNode, MetadataKey)
 }
 
 func (template *Template) metadataHandler(tag string, value string) (*yamlast.Node, error) {
@@ -204,9 +368,53 @@ func (template *Template) metadataHandler(tag string, value string) (*yamlast.No
 	return nil, fmt.Errorf("Unknown metadata value: %s", value)
 }
 
-// Converts a template to a json string.
+func (template *Template) configHandler(tag string, value string) (*yamlast.Node, error) {
+	return template.Config.ConfigValue(value)
+}
+
+func (template *Template) envHandler(tag string, value string) (*yamlast.Node, error) {
+	if template.Config.Environment == "" {
+		return nil, errors.New("!env needs an environment, set with --env")
+	}
+
+	return &yamlast.Node{Kind: yamlast.ScalarNode, Value: template.Config.Environment}, nil
+}
+
+// envVarHandler reads an environment variable listed in the config's EnvVars.
+// NAME:-default falls back to default when the variable is unset or empty.
+func (template *Template) envVarHandler(tag string, value string) (*yamlast.Node, error) {
+	name, defaultValue, hasDefault := strings.Cut(strings.TrimSpace(value), ":-")
+	if !template.Config.EnvVarAllowed(name) {
+		return nil, fmt.Errorf("Environment variable %s isn't allowed by EnvVars in %s", name, ConfigFile)
+	}
+
+	envValue, ok := os.LookupEnv(name)
+	if hasDefault && envValue == "" {
+		envValue, ok = defaultValue, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("Environment variable %s is not set", name)
+	}
+
+	return &yamlast.Node{Kind: yamlast.ScalarNode, Value: envValue}, nil
+}
+
+// Converts a template to a json string, formatted as the config's output
+// settings ask for. Metadata sections are left out unless KeepMetadata is set.
 func (template *Template) ToJSON() string {
-	jsonData, err := json.MarshalIndent(nodeToInterface(template.DocumentNode, nil), "", "  ")
+	data := nodeToInterface(template.DocumentNode, nil, !template.KeepMetadata)
+
+	var jsonData []byte
+	var err error
+	if template.Config.CompactOutput {
+		jsonData, err = json.Marshal(data)
+	} else {
+		indent := template.Config.OutputIndent
+		if indent == 0 {
+			indent = defaultIndent
+		}
+		jsonData, err = json.MarshalIndent(data, "", strings.Repeat(" ", indent))
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -214,12 +422,13 @@ func (template *Template) ToJSON() string {
 	return string(jsonData)
 }
 
-// Converts a node to an object
-func nodeToInterface(node *yamlast.Node, parent *yamlast.Node) interface{} {
+// Converts a node to an object. With stripMetadata, the metadata sections at
+// the paths isMetadataPath accepts are left out.
+func nodeToInterface(node *yamlast.Node, path []selectorPart, stripMetadata bool) interface{} {
 	switch node.Kind {
 	case yamlast.DocumentNode:
 		if len(node.Children) > 0 {
-			return nodeToInterface(node.Children[0], node)
+			return nodeToInterface(node.Children[0], path, stripMetadata)
 		}
 		return nil
 
@@ -230,9 +439,9 @@ func nodeToInterface(node *yamlast.Node, parent *yamlast.Node) interface{} {
 			key := node.Children[i*2]
 			value := node.Children[i*2+1]
 
-			// Filter out metadata nodes
-			if parent.Kind != yamlast.DocumentNode || key.Value != MetadataKey {
-				mapping[key.Value] = nodeToInterface(value, node)
+			childPath := append(append([]selectorPart{}, path...), selectorPart{Key: key.Value})
+			if !stripMetadata || !isMetadataPath(childPath) {
+				mapping[key.Value] = nodeToInterface(value, childPath, stripMetadata)
 			}
 		}
 		return mapping
@@ -240,8 +449,9 @@ func nodeToInterface(node *yamlast.Node, parent *yamlast.Node) interface{} {
 	case yamlast.SequenceNode:
 		sequence := []interface{}{}
 
-		for _, child := range node.Children {
-			sequence = append(sequence, nodeToInterface(child, node))
+		for i, child := range node.Children {
+			childPath := append(append([]selectorPart{}, path...), selectorPart{Index: i, IsIndex: true})
+			sequence = append(sequence, nodeToInterface(child, childPath, stripMetadata))
 		}
 
 		return sequence
@@ -254,3 +464,16 @@ func nodeToInterface(node *yamlast.Node, parent *yamlast.Node) interface{} {
 		panic("Unsupported node type.")
 	}
 }
+
+// isMetadataPath is true for the paths metadata sections live at: the
+// template's top-level CFToolMetadata, and a CFToolMetadata block in a
+// resource for build-time annotations.
+func isMetadataPath(path []selectorPart) bool {
+	last := len(path) - 1
+	if last < 0 || path[last].IsIndex || path[last].Key != MetadataKey {
+		return false
+	}
+
+	return len(path) == 1 ||
+		(len(path) == 3 && !path[0].IsIndex && path[0].Key == "Resources" && !path[1].IsIndex)
+}
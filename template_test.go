@@ -1,6 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/commondream/yamlast"
@@ -8,7 +13,8 @@ import (
 )
 
 func TestMetadata(t *testing.T) {
-	config := LoadConfig()
+	config, err := LoadConfig()
+	assert.Nil(t, err)
 	template := NewTemplate(config)
 	template.LoadFile("fixtures/template/metadata.yml")
 
@@ -18,3 +24,465 @@ func TestMetadata(t *testing.T) {
 	assert.Equal(t, yamlast.ScalarNode, node.Kind)
 	assert.Equal(t, "Rad", node.Value)
 }
+
+func TestEncrypted(t *testing.T) {
+	key, err := GenerateKey()
+	assert.Nil(t, err)
+
+	template := NewTemplate(&Config{VaultKey: key})
+	err = template.LoadSource([]byte("Password: !encrypted " + Encrypt("hunter2", key) + "\n"))
+	assert.Nil(t, err)
+
+	node := yamlast.SelectNode(template.DocumentNode, "Password")
+	assert.NotNil(t, node)
+	assert.Equal(t, "hunter2", node.Value)
+}
+
+func TestSecretLeaks(t *testing.T) {
+	vault, err := yamlast.Parse([]byte("Db:\n  Password: hunter2\n"))
+	assert.Nil(t, err)
+
+	template := NewTemplate(&Config{VaultAST: vault, vaultLoaded: true})
+	err = template.LoadSource([]byte(`
+Parameters:
+  DbPassword:
+    Type: String
+    NoEcho: true
+    Default: !vault Db.Password
+  Plain:
+    Type: String
+    Default: !vault Db.Password
+Resources:
+  Db:
+    Type: AWS::RDS::DBInstance
+    Properties:
+      MasterUserPassword: !vault Db.Password
+  Instance:
+    Type: AWS::EC2::Instance
+    Properties:
+      UserData: !vault Db.Password
+`))
+	assert.Nil(t, err)
+
+	leaks := template.SecretLeaks()
+	assert.Equal(t, 2, len(leaks))
+	assert.Equal(t, "Parameters.Plain.Default", leaks[0].Path)
+	assert.Equal(t, "Resources.Instance.Properties.UserData", leaks[1].Path)
+	assert.Equal(t, "!vault Db.Password", leaks[0].Source)
+
+	// Metadata only counts when it's kept in the output.
+	metadataSource := []byte("CFToolMetadata:\n  Password: !vault Db.Password\n")
+	template = NewTemplate(&Config{VaultAST: vault, vaultLoaded: true})
+	err = template.LoadSource(metadataSource)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(template.SecretLeaks()))
+
+	template = NewTemplate(&Config{VaultAST: vault, vaultLoaded: true})
+	template.KeepMetadata = true
+	err = template.LoadSource(metadataSource)
+	assert.Nil(t, err)
+	leaks = template.SecretLeaks()
+	assert.Equal(t, 1, len(leaks))
+	assert.Equal(t, "CFToolMetadata.Password", leaks[0].Path)
+}
+
+func TestSecretsAsParameters(t *testing.T) {
+	vault, err := yamlast.Parse([]byte("Db:\n  Password: hunter2\n"))
+	assert.Nil(t, err)
+
+	template := NewTemplate(&Config{VaultAST: vault, vaultLoaded: true})
+	template.SecretsAsParameters = true
+	err = template.LoadSource([]byte(`
+Resources:
+  Db:
+    Type: AWS::RDS::DBInstance
+    Properties:
+      MasterUserPassword: !vault Db.Password
+`))
+	assert.Nil(t, err)
+
+	ref := yamlast.SelectNode(template.DocumentNode, "Resources.Db.Properties.MasterUserPassword.Ref")
+	assert.NotNil(t, ref)
+	assert.Equal(t, "VaultDbPassword", ref.Value)
+
+	noEcho := yamlast.SelectNode(template.DocumentNode, "Parameters.VaultDbPassword.NoEcho")
+	assert.NotNil(t, noEcho)
+	assert.Equal(t, "true", noEcho.Value)
+
+	assert.Equal(t, []SecretParameter{{ParameterKey: "VaultDbPassword", ParameterValue: "hunter2"}},
+		template.SecretParameters())
+	assert.Equal(t, 0, len(template.SecretLeaks()))
+}
+
+func TestConfig(t *testing.T) {
+	configAST, err := yamlast.Parse([]byte(`
+Network:
+  VpcId: vpc-1234
+  Subnets: [subnet-a, subnet-b]
+Environments:
+  prod:
+    Network:
+      VpcId: vpc-5678
+`))
+	assert.Nil(t, err)
+
+	source := []byte("Vpc: !config Network.VpcId\nSubnet: !config Network.Subnets[1]\n")
+	config := &Config{ConfigAST: configAST}
+	template := NewTemplate(config)
+	err = template.LoadSource(source)
+	assert.Nil(t, err)
+	assert.Equal(t, "vpc-1234", yamlast.SelectNode(template.DocumentNode, "Vpc").Value)
+	assert.Equal(t, "subnet-b", yamlast.SelectNode(template.DocumentNode, "Subnet").Value)
+
+	config.Environment = "prod"
+	template = NewTemplate(config)
+	err = template.LoadSource(source)
+	assert.Nil(t, err)
+	assert.Equal(t, "vpc-5678", yamlast.SelectNode(template.DocumentNode, "Vpc").Value)
+	assert.Equal(t, "subnet-b", yamlast.SelectNode(template.DocumentNode, "Subnet").Value)
+
+	template = NewTemplate(config)
+	err = template.LoadSource([]byte("Ami: !config Images.Base\n"))
+	assert.NotNil(t, err)
+}
+
+func TestEnvironmentOverlays(t *testing.T) {
+	for environment, instanceType := range map[string]string{"prod": "m4.large", "staging": "t2.small"} {
+		template := NewTemplate(&Config{Environment: environment})
+		err := template.LoadFile("fixtures/template/environment.yml")
+		assert.Nil(t, err)
+
+		properties := "Resources.Instance.Properties."
+		assert.Equal(t, instanceType, selectNode(template.DocumentNode, properties+"InstanceType").Value)
+		assert.Equal(t, "ami-08111162", selectNode(template.DocumentNode, properties+"ImageId").Value)
+		assert.Equal(t, environment, selectNode(template.DocumentNode, properties+"Tags[0].Value").Value)
+	}
+
+	template := NewTemplate(&Config{Environment: "qa"})
+	err := template.LoadFile("fixtures/template/environment.yml")
+	assert.NotNil(t, err)
+
+	template = NewTemplate(&Config{})
+	err = template.LoadFile("fixtures/template/environment.yml")
+	assert.NotNil(t, err)
+}
+
+func TestEnvVar(t *testing.T) {
+	os.Setenv("CFTOOL_TEST_BUILD", "42")
+	defer os.Unsetenv("CFTOOL_TEST_BUILD")
+	os.Unsetenv("CFTOOL_TEST_SHA")
+
+	config := &Config{EnvVars: []string{"CFTOOL_TEST_BUILD", "CFTOOL_TEST_SHA"}}
+	template := NewTemplate(config)
+	err := template.LoadSource([]byte("Build: !envvar CFTOOL_TEST_BUILD\nSha: !envvar CFTOOL_TEST_SHA:-unknown\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "42", selectNode(template.DocumentNode, "Build").Value)
+	assert.Equal(t, "unknown", selectNode(template.DocumentNode, "Sha").Value)
+
+	template = NewTemplate(config)
+	err = template.LoadSource([]byte("Sha: !envvar CFTOOL_TEST_SHA\n"))
+	assert.NotNil(t, err)
+
+	template = NewTemplate(config)
+	err = template.LoadSource([]byte("Home: !envvar HOME\n"))
+	assert.NotNil(t, err)
+}
+
+func TestForeach(t *testing.T) {
+	template := NewTemplate(&Config{})
+	err := template.LoadFile("fixtures/template/foreach.yml")
+	assert.Nil(t, err)
+
+	resources := selectNode(template.DocumentNode, "Resources")
+	assert.Equal(t, 8, len(resources.Children))
+	assert.Equal(t, "orders-queue", selectNode(resources, "Queue0.Properties.QueueName").Value)
+	assert.Equal(t, "emails-queue", selectNode(resources, "Queue1.Properties.QueueName").Value)
+	assert.Equal(t, "us-east-1b", selectNode(resources, "Subnetb.Properties.AvailabilityZone").Value)
+	assert.Equal(t, "10.0.1.0/24", selectNode(resources, "Subnetb.Properties.CidrBlock").Value)
+	assert.Equal(t, "Vpc", selectNode(resources, "Subneta.Properties.VpcId.Ref").Value)
+	assert.Equal(t, "Owner", selectNode(resources, "Subneta.Properties.Tags[1].Key").Value)
+	assert.Equal(t, "1", selectNode(resources, "Subneta.Properties.Tags[1].Value").Value)
+
+	template = NewTemplate(&Config{})
+	err = template.LoadSource([]byte(`
+Resources:
+  Queue: {Type: AWS::SQS::Queue}
+  Queues: !foreach
+    Items: [a, ""]
+    Body:
+      Queue${item}: {Type: AWS::SQS::Queue}
+`))
+	assert.NotNil(t, err)
+}
+
+func TestConditionals(t *testing.T) {
+	configAST, err := yamlast.Parse([]byte("Environments:\n  prod:\n"))
+	assert.Nil(t, err)
+
+	template := NewTemplate(&Config{ConfigAST: configAST, Environment: "prod"})
+	err = template.LoadFile("fixtures/template/conditionals.yml")
+	assert.Nil(t, err)
+
+	assert.Equal(t, "AWS::WAFv2::WebACL", selectNode(template.DocumentNode, "Resources.Waf.Type").Value)
+	assert.Equal(t, "m4.large", selectNode(template.DocumentNode, "Resources.Instance.Properties.InstanceType").Value)
+	assert.Equal(t, 1, len(selectNode(template.DocumentNode, "Resources.Instance.Properties.Tags").Children))
+	assert.NotNil(t, selectNode(template.DocumentNode, "Resources.Alarm"))
+
+	template = NewTemplate(&Config{})
+	err = template.LoadFile("fixtures/template/conditionals.yml")
+	assert.Nil(t, err)
+
+	assert.Nil(t, selectNode(template.DocumentNode, "Resources.Waf"))
+	assert.Equal(t, "t2.nano", selectNode(template.DocumentNode, "Resources.Instance.Properties.InstanceType").Value)
+}
+
+func TestTpl(t *testing.T) {
+	configAST, err := yamlast.Parse([]byte("Region: eu-west-1\nEnvironments:\n  prod:\n"))
+	assert.Nil(t, err)
+	vault, err := yamlast.Parse([]byte("Db:\n  Password: hunter2\n"))
+	assert.Nil(t, err)
+
+	config := &Config{ConfigAST: configAST, Environment: "prod", VaultAST: vault, vaultLoaded: true}
+	template := NewTemplate(config)
+	err = template.LoadSource([]byte(`
+CFToolMetadata:
+  App: MyApp
+  Zones: [a, b]
+Bucket: !tpl "{{ lower .Meta.App }}-{{ .Env }}-logs"
+Zones: !tpl '{{ join "," .Meta.Zones }} in {{ .Config.Region | upper | replace "-" "_" }}'
+Hash: !tpl "{{ sha256 .Env }}"
+Name: !tpl
+  Template: "{{ .Args.Prefix }}-{{ .Args.Region }}"
+  Args:
+    Prefix: web
+    Region: !config Region
+Secret: !tpl "{{ vault \"Db.Password\" }}"
+`))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "myapp-prod-logs", selectNode(template.DocumentNode, "Bucket").Value)
+	assert.Equal(t, "a,b in EU_WEST_1", selectNode(template.DocumentNode, "Zones").Value)
+	assert.Equal(t, "6754af9632a2", selectNode(template.DocumentNode, "Hash").Value)
+	assert.Equal(t, "web-eu-west-1", selectNode(template.DocumentNode, "Name").Value)
+	assert.Equal(t, "hunter2", selectNode(template.DocumentNode, "Secret").Value)
+	assert.Equal(t, 1, len(template.SecretLeaks()))
+
+	template = NewTemplate(config)
+	err = template.LoadSource([]byte("Bucket: !tpl \"{{ .Meta.Missing }}\"\n"))
+	assert.NotNil(t, err)
+
+	// Vault values passed in through Args make the result secret too.
+	argsSource := []byte(`
+UserData: !tpl
+  Template: "pw={{ .Args.Password }}"
+  Args:
+    Password: !vault Db.Password
+`)
+	template = NewTemplate(config)
+	err = template.LoadSource(argsSource)
+	assert.Nil(t, err)
+	assert.Equal(t, "pw=hunter2", selectNode(template.DocumentNode, "UserData").Value)
+	assert.Equal(t, 1, len(template.SecretLeaks()))
+
+	// Parameters can't be rendered into a string.
+	template = NewTemplate(config)
+	template.SecretsAsParameters = true
+	err = template.LoadSource(argsSource)
+	assert.NotNil(t, err)
+
+	template = NewTemplate(config)
+	template.SecretsAsParameters = true
+	err = template.LoadSource([]byte("Secret: !tpl \"{{ vault \\\"Db.Password\\\" }}\"\n"))
+	assert.NotNil(t, err)
+}
+
+func TestFileModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	longLine := strings.Repeat("x", 100*1024)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "script.sh"), []byte("#!/bin/sh\necho ${AWS::Region}"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "long.txt"), []byte(longLine+"\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "key.der"), []byte{0xff, 0x00, 0xfe}, 0644))
+
+	template := NewTemplate(&Config{FilesPath: dir})
+	err = template.LoadSource([]byte(`
+Join: !file script.sh
+Long: !file long.txt
+String: !file:string script.sh
+Base64: !file:base64 script.sh
+Sub: !file
+  Path: script.sh
+  Mode: sub
+Bytes: !file:bytes key.der
+`))
+	assert.Nil(t, err)
+
+	lines := selectNode(template.DocumentNode, `Join."Fn::Join"[1]`)
+	assert.Equal(t, 2, len(lines.Children))
+	assert.Equal(t, "echo ${AWS::Region}", lines.Children[1].Value)
+	assert.Equal(t, longLine+"\n", selectNode(template.DocumentNode, `Long."Fn::Join"[1][0]`).Value)
+	assert.Equal(t, "#!/bin/sh\necho ${AWS::Region}", selectNode(template.DocumentNode, "String").Value)
+	assert.Equal(t, "#!/bin/sh\necho ${AWS::Region}", selectNode(template.DocumentNode, `Base64."Fn::Base64"`).Value)
+	assert.Equal(t, "#!/bin/sh\necho ${AWS::Region}", selectNode(template.DocumentNode, `Sub."Fn::Sub"`).Value)
+	assert.Equal(t, "/wD+", selectNode(template.DocumentNode, "Bytes").Value)
+
+	template = NewTemplate(&Config{FilesPath: dir})
+	err = template.LoadSource([]byte("Key: !file key.der\n"))
+	assert.NotNil(t, err)
+
+	template = NewTemplate(&Config{FilesPath: dir})
+	err = template.LoadSource([]byte("Key: !file:gzip script.sh\n"))
+	assert.NotNil(t, err)
+}
+
+func TestFileReferences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	script := "aws s3 cp app.zip s3://{{ref \"Bucket\"}}/\nDB={{ getatt \"Db\" \"Endpoint.Address\" }} PASS={{vault \"Db.Password\"}}\n{{ other }}\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "setup.sh"), []byte(script), 0644))
+
+	vault, err := yamlast.Parse([]byte("Db:\n  Password: p${w}\n"))
+	assert.Nil(t, err)
+
+	template := NewTemplate(&Config{FilesPath: dir, VaultAST: vault, vaultLoaded: true})
+	err = template.LoadSource([]byte(`
+Resources:
+  Instance:
+    Type: AWS::EC2::Instance
+    Properties:
+      UserData: !file:base64 setup.sh
+Sub: !file:sub setup.sh
+`))
+	assert.Nil(t, err)
+
+	parts := selectNode(template.DocumentNode, `Resources.Instance.Properties.UserData."Fn::Base64"."Fn::Join"[1]`)
+	assert.Equal(t, 7, len(parts.Children))
+	assert.Equal(t, "aws s3 cp app.zip s3://", parts.Children[0].Value)
+	assert.Equal(t, "Bucket", selectNode(parts.Children[1], "Ref").Value)
+	assert.Equal(t, "/\nDB=", parts.Children[2].Value)
+	assert.Equal(t, "Endpoint.Address", selectNode(parts.Children[3], `"Fn::GetAtt"[1]`).Value)
+	assert.Equal(t, "p${w}", parts.Children[5].Value)
+	assert.Equal(t, "\n{{ other }}\n", parts.Children[6].Value)
+	assert.Equal(t, 2, len(template.SecretLeaks()))
+
+	assert.Equal(t, "aws s3 cp app.zip s3://${Bucket}/\nDB=${Db.Endpoint.Address} PASS=p${!w}\n{{ other }}\n",
+		selectNode(template.DocumentNode, `Sub."Fn::Sub"`).Value)
+
+	// Files with only vault references are still rendered and tracked.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "password.txt"), []byte("pw={{vault \"Db.Password\"}}\n"), 0644))
+	template = NewTemplate(&Config{FilesPath: dir, VaultAST: vault, vaultLoaded: true})
+	err = template.LoadSource([]byte(`
+String: !file:string password.txt
+Base64: !file:base64 password.txt
+`))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "pw=p${w}\n", selectNode(template.DocumentNode, "String").Value)
+	assert.Equal(t, "pw=p${w}\n", selectNode(template.DocumentNode, `Base64."Fn::Base64"`).Value)
+	assert.Equal(t, 2, len(template.SecretLeaks()))
+}
+
+func TestJSONAndText(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	policy := `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {"Effect": "Allow", "Action": ["s3:GetObject"], "Resource": "*", "Condition": null, "Priority": 1.50}
+  ]
+}
+`
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "policy.json"), []byte(policy), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("a \"quoted\"\nnote"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte("{\"a\": 1} 2"), 0644))
+
+	template := NewTemplate(&Config{FilesPath: dir})
+	err = template.LoadSource([]byte("Policy: !json policy.json\nBody: !text policy.json\nNotes: !text notes.txt\n"))
+	assert.Nil(t, err)
+
+	policyNode := selectNode(template.DocumentNode, "Policy")
+	assert.Equal(t, "Version", policyNode.Children[0].Value)
+	assert.Equal(t, "Statement", policyNode.Children[2].Value)
+	assert.Equal(t, "s3:GetObject", selectNode(policyNode, "Statement[0].Action[0]").Value)
+	assert.Equal(t, "1.50", selectNode(policyNode, "Statement[0].Priority").Value)
+	assert.Equal(t, `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":["s3:GetObject"],"Resource":"*","Condition":null,"Priority":1.50}]}`,
+		selectNode(template.DocumentNode, "Body").Value)
+	assert.Equal(t, "a \"quoted\"\nnote", selectNode(template.DocumentNode, "Notes").Value)
+
+	template = NewTemplate(&Config{FilesPath: dir})
+	err = template.LoadSource([]byte("Policy: !json broken.json\n"))
+	assert.NotNil(t, err)
+}
+
+func TestMultipleDocuments(t *testing.T) {
+	template := NewTemplate(&Config{})
+	err := template.LoadFile("fixtures/template/documents.yml")
+	assert.Nil(t, err)
+	assert.Equal(t, "shop", selectNode(template.DocumentNode, "Resources.Bucket.Properties.BucketName").Value)
+
+	stacks, err := TemplateStacks("fixtures/template/stacks.yml")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"web", "worker"}, stacks)
+
+	template = NewTemplate(&Config{})
+	template.Stack = "web"
+	err = template.LoadFile("fixtures/template/stacks.yml")
+	assert.Nil(t, err)
+	assert.Equal(t, "shop", selectNode(template.DocumentNode, "Resources.Bucket.Properties.BucketName").Value)
+	assert.NotNil(t, selectNode(template.DocumentNode, "Resources.Topic"))
+	assert.Nil(t, selectNode(template.DocumentNode, "Resources.Queue"))
+
+	template = NewTemplate(&Config{})
+	err = template.LoadFile("fixtures/template/stacks.yml")
+	assert.NotNil(t, err)
+
+	template = NewTemplate(&Config{})
+	template.Stack = "api"
+	err = template.LoadFile("fixtures/template/stacks.yml")
+	assert.NotNil(t, err)
+
+	// Empty documents, like the one after a trailing ---, are skipped.
+	template = NewTemplate(&Config{})
+	err = template.LoadSource([]byte("A: 1\n---\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", selectNode(template.DocumentNode, "A").Value)
+
+	template = NewTemplate(&Config{})
+	err = template.LoadSource([]byte("# Shared\n---\nA: 1\n...\n--- ~\n---\nB: !when {Condition: yes, Then: 2}\n---\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", selectNode(template.DocumentNode, "A").Value)
+	assert.Equal(t, "2", selectNode(template.DocumentNode, "B").Value)
+}
+
+func TestMetadataIsStripped(t *testing.T) {
+	var output map[string]interface{}
+
+	template := NewTemplate(&Config{ImportsPath: "fixtures/template/imports"})
+	err := template.LoadFile("fixtures/template/resource_metadata.yml")
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal([]byte(template.ToJSON()), &output))
+
+	assert.Nil(t, output[MetadataKey])
+	resources := output["Resources"].(map[string]interface{})
+	assert.Nil(t, resources["Bucket"].(map[string]interface{})[MetadataKey])
+	assert.Nil(t, resources["Topic"].(map[string]interface{})[MetadataKey])
+	assert.Equal(t, "AWS::SNS::Topic", resources["Topic"].(map[string]interface{})["Type"])
+
+	template = NewTemplate(&Config{ImportsPath: "fixtures/template/imports"})
+	template.KeepMetadata = true
+	err = template.LoadFile("fixtures/template/resource_metadata.yml")
+	assert.Nil(t, err)
+	output = nil
+	assert.Nil(t, json.Unmarshal([]byte(template.ToJSON()), &output))
+
+	assert.NotNil(t, output[MetadataKey])
+	resources = output["Resources"].(map[string]interface{})
+	assert.NotNil(t, resources["Bucket"].(map[string]interface{})[MetadataKey])
+	assert.NotNil(t, resources["Topic"].(map[string]interface{})[MetadataKey])
+}
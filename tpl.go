@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/commondream/yamlast"
+)
+
+// tplData is what !tpl templates can refer to.
+type tplData struct {
+	Meta   interface{}
+	Config interface{}
+	Env    string
+	Args   interface{}
+}
+
+// tplHandler renders a Go text/template into a string. The tag goes on a
+// scalar holding the template, or on a mapping with the template as Template
+// and values for it as Args.
+func (template *Template) tplHandler(node *yamlast.Node) (*yamlast.Node, error) {
+	source := node.Value
+	var args interface{}
+	secretArgs := false
+
+	switch node.Kind {
+	case yamlast.ScalarNode:
+	case yamlast.MappingNode:
+		templateNode := selectNode(node, "Template")
+		if templateNode == nil || templateNode.Kind != yamlast.ScalarNode {
+			return nil, errors.New("!tpl needs a Template string")
+		}
+		source = templateNode.Value
+
+		argsNode := selectNode(node, "Args")
+		if argsNode != nil {
+			// Args can come from tags like !meta or !config.
+			resolved, err := template.resolveNode(argsNode)
+			if err != nil {
+				return nil, err
+			}
+			secretArgs, err = template.holdsSecret(resolved)
+			if err != nil {
+				return nil, err
+			}
+			args = nodeValue(resolved)
+		}
+	default:
+		return nil, errors.New("!tpl needs a template string")
+	}
+
+	data := tplData{Env: template.Config.Environment, Args: args}
+	if metadata := template.metadataNode(); metadata != nil {
+		data.Meta = nodeValue(metadata)
+	}
+	if settings := template.Config.settings(); settings != nil {
+		data.Config = nodeValue(settings)
+	}
+
+	usedVault := false
+	tpl, err := texttemplate.New("!tpl").
+		Option("missingkey=error").
+		Funcs(template.tplFuncs(&usedVault)).
+		Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing !tpl template: %s", err)
+	}
+
+	var out bytes.Buffer
+	err = tpl.Execute(&out, data)
+	if err != nil {
+		return nil, fmt.Errorf("Error rendering !tpl template: %s", err)
+	}
+
+	rendered := &yamlast.Node{Kind: yamlast.ScalarNode, Value: out.String()}
+	if usedVault || secretArgs {
+		template.markSecret(rendered, "!tpl "+source)
+	}
+
+	return rendered, nil
+}
+
+// tplFuncs are the functions available to !tpl templates. None of them can
+// reach the file system or the environment. usedVault is set when the
+// template reads the vault.
+func (template *Template) tplFuncs(usedVault *bool) texttemplate.FuncMap {
+	return texttemplate.FuncMap{
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		"replace": func(old string, new string, s string) string {
+			return strings.Replace(s, old, new, -1)
+		},
+		"join": func(sep string, values []interface{}) string {
+			var parts []string
+			for _, value := range values {
+				parts = append(parts, fmt.Sprint(value))
+			}
+			return strings.Join(parts, sep)
+		},
+		"sha256": func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])[:12]
+		},
+		"vault": func(selector string) (string, error) {
+			if template.SecretsAsParameters {
+				return "", errors.New("vault can't be used with --secrets-as-parameters, the value would end up in the template")
+			}
+
+			err := template.Config.LoadVault()
+			if err != nil {
+				return "", err
+			}
+
+			node := selectNode(template.Config.VaultAST, selector)
+			if node == nil || node.Kind != yamlast.ScalarNode {
+				return "", fmt.Errorf("Unknown vault value: %s", selector)
+			}
+
+			*usedVault = true
+			return node.Value, nil
+		},
+	}
+}
+
+// holdsSecret reports whether a resolved !tpl Args node contains a vault
+// value. With --secrets-as-parameters vault values are references to
+// parameters, which can't be rendered into a string, so those are an error.
+func (template *Template) holdsSecret(node *yamlast.Node) (bool, error) {
+	if _, ok := template.secretNodes[node]; ok {
+		return true, nil
+	}
+
+	if node.Kind == yamlast.MappingNode && len(node.Children) == 2 && node.Children[0].Value == "Ref" {
+		for _, parameter := range template.secretParameters {
+			if parameter.ParameterKey == node.Children[1].Value {
+				return false, errors.New("!tpl Args can't hold vault values with --secrets-as-parameters, the value would end up in the template")
+			}
+		}
+	}
+
+	secret := false
+	for _, child := range node.Children {
+		childSecret, err := template.holdsSecret(child)
+		if err != nil {
+			return false, err
+		}
+		secret = secret || childSecret
+	}
+
+	return secret, nil
+}
+
+// nodeValue converts a node to plain values for use as template data.
+func nodeValue(node *yamlast.Node) interface{} {
+	return nodeToInterface(node, nil, false)
+}
@@ -1,16 +1,66 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+
+	"golang.org/x/crypto/scrypt"
 )
 
 const nonceLength = 12
 
+const (
+	// VaultHeaderPrefix marks the first line of a vault file that carries a
+	// header. Vault files without it are plain base64 ciphertext.
+	VaultHeaderPrefix = "$CFTOOL_VAULT;1"
+
+	// PassphraseVaultKey is written to .vaultkey to select passphrase derived
+	// keys instead of a shared random key.
+	PassphraseVaultKey = "passphrase:scrypt"
+
+	saltLength = 16
+	scryptN    = 32768
+	scryptR    = 8
+	scryptP    = 1
+
+	// Upper bounds for KDF parameters read from vault headers, so a tampered
+	// header can't make us allocate huge amounts of memory.
+	maxScryptN = 1 << 20
+	maxScryptR = 32
+	maxScryptP = 16
+)
+
+var errPassphraseKey = errors.New(".vaultkey selects passphrase mode")
+
+// VaultHeader describes how the key for a vault file is obtained and what
+// name, if any, the ciphertext is bound to.
+type VaultHeader struct {
+	KDF         string
+	N, R, P     int
+	Salt        []byte
+	KeyProvider string
+	DataKey     []byte
+	Recipients  []Recipient
+	Name        string
+}
+
+// VaultOptions controls how EncryptVault encrypts a vault.
+type VaultOptions struct {
+	// Name binds the vault to a name. See EncryptVault.
+	Name string
+
+	// Recipients are the public keys to wrap the vault's data key for. When
+	// set they're used instead of the configured key.
+	Recipients []string
+}
+
 // GenerateKey generates a random key and base64 encodes it
 func GenerateKey() ([]byte, error) {
 	b := make([]byte, 32)
@@ -28,75 +78,421 @@ func EncodeVaultKey(key []byte) string {
 	return base64.StdEncoding.EncodeToString(key)
 }
 
-// LoadVaultKey loads and returns a vault key.
-func LoadVaultKey() ([]byte, error) {
-	keyBase64, err := ioutil.ReadFile(".vaultkey")
+// NewPassphraseHeader returns a header for a passphrase derived key with a
+// fresh random salt.
+func NewPassphraseHeader() (*VaultHeader, error) {
+	salt := make([]byte, saltLength)
+	_, err := rand.Read(salt)
 	if err != nil {
-		return []byte{}, err
+		return nil, err
 	}
 
-	key := make([]byte, base64.StdEncoding.DecodedLen(len(keyBase64)))
-	_, err = base64.StdEncoding.Decode(key, keyBase64)
+	return &VaultHeader{KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP, Salt: salt}, nil
+}
+
+// DeriveKey derives a vault key from a passphrase using the KDF settings in
+// the header.
+func DeriveKey(passphrase []byte, header *VaultHeader) ([]byte, error) {
+	if header.KDF != "scrypt" {
+		return nil, fmt.Errorf("Unsupported vault KDF: %s", header.KDF)
+	}
+
+	return scrypt.Key(passphrase, header.Salt, header.N, header.R, header.P, 32)
+}
+
+// FormatVault writes out a vault file's contents. Vaults without a header are
+// written as plain base64 so older versions of cftool can still read them.
+func FormatVault(header *VaultHeader, payload string) string {
+	if header == nil {
+		return payload
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintln(&out, VaultHeaderPrefix)
+	if header.KDF != "" {
+		fmt.Fprintf(&out, "KDF: %s N=%d r=%d p=%d\n", header.KDF, header.N, header.R, header.P)
+		fmt.Fprintf(&out, "Salt: %s\n", base64.StdEncoding.EncodeToString(header.Salt))
+	}
+	if header.KeyProvider != "" {
+		fmt.Fprintf(&out, "Key-Provider: %s\n", header.KeyProvider)
+		fmt.Fprintf(&out, "Data-Key: %s\n", base64.StdEncoding.EncodeToString(header.DataKey))
+	}
+	for _, recipient := range header.Recipients {
+		fmt.Fprintf(&out, "Recipient: %s %s %s\n", recipient.PublicKey,
+			base64.StdEncoding.EncodeToString(recipient.EphemeralKey),
+			base64.StdEncoding.EncodeToString(recipient.WrappedKey))
+	}
+	if header.Name != "" {
+		fmt.Fprintf(&out, "Name: %s\n", header.Name)
+	}
+	fmt.Fprintln(&out, payload)
+
+	return out.String()
+}
+
+// ParseVault splits a vault file into its header and base64 payload. The
+// header is nil for vault files that don't have one.
+func ParseVault(data []byte) (*VaultHeader, string, error) {
+	if !bytes.HasPrefix(data, []byte(VaultHeaderPrefix)) {
+		return nil, strings.TrimSpace(string(data)), nil
+	}
+
+	header := &VaultHeader{}
+	var payload []string
+
+	// The payload is a single line that can be far longer than a
+	// bufio.Scanner allows, so the lines are split by hand.
+	for _, rawLine := range bytes.Split(data, []byte("\n"))[1:] {
+		line := strings.TrimSpace(string(rawLine))
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 {
+			payload = append(payload, line)
+			continue
+		}
+
+		var err error
+		switch parts[0] {
+		case "KDF":
+			err = header.parseKDF(parts[1])
+		case "Salt":
+			header.Salt, err = base64.StdEncoding.DecodeString(parts[1])
+		case "Key-Provider":
+			header.KeyProvider = parts[1]
+		case "Data-Key":
+			header.DataKey, err = base64.StdEncoding.DecodeString(parts[1])
+		case "Recipient":
+			err = header.parseRecipient(parts[1])
+		case "Name":
+			header.Name = parts[1]
+		default:
+			err = fmt.Errorf("Unknown vault header field: %s", parts[0])
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	return header, strings.Join(payload, ""), nil
+}
+
+// usesVaultKey is true for vaults encrypted directly with the .vaultkey key.
+func (header *VaultHeader) usesVaultKey() bool {
+	return header == nil || (header.KDF == "" && header.KeyProvider == "" && len(header.Recipients) == 0)
+}
+
+// Options returns the options that re-encrypt a vault the same way: bound to
+// the same name and for the same recipients.
+func (header *VaultHeader) Options() VaultOptions {
+	options := VaultOptions{}
+	if header == nil {
+		return options
+	}
+
+	options.Name = header.Name
+	for _, recipient := range header.Recipients {
+		options.Recipients = append(options.Recipients, recipient.PublicKey)
+	}
+
+	return options
+}
+
+func (header *VaultHeader) parseRecipient(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return fmt.Errorf("Invalid vault recipient: %s", value)
+	}
+
+	ephemeralKey, err := base64.StdEncoding.DecodeString(fields[1])
 	if err != nil {
-		return []byte{}, err
+		return fmt.Errorf("Invalid vault recipient: %s", value)
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return fmt.Errorf("Invalid vault recipient: %s", value)
+	}
+
+	header.Recipients = append(header.Recipients,
+		Recipient{PublicKey: fields[0], EphemeralKey: ephemeralKey, WrappedKey: wrappedKey})
+	return nil
+}
+
+func (header *VaultHeader) parseKDF(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return errors.New("Empty vault KDF header")
 	}
 
-	return key[:32], nil
+	header.KDF = fields[0]
+	for _, field := range fields[1:] {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid vault KDF parameter: %s", field)
+		}
+
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return fmt.Errorf("Invalid vault KDF parameter: %s", field)
+		}
+
+		switch parts[0] {
+		case "N":
+			header.N = n
+		case "r":
+			header.R = n
+		case "p":
+			header.P = n
+		default:
+			return fmt.Errorf("Unknown vault KDF parameter: %s", field)
+		}
+	}
+
+	if header.N < 2 || header.N > maxScryptN || header.N&(header.N-1) != 0 {
+		return fmt.Errorf("Invalid vault KDF parameter N=%d: it must be a power of two up to %d", header.N, maxScryptN)
+	}
+	if header.R < 1 || header.R > maxScryptR {
+		return fmt.Errorf("Invalid vault KDF parameter r=%d: it must be between 1 and %d", header.R, maxScryptR)
+	}
+	if header.P < 1 || header.P > maxScryptP {
+		return fmt.Errorf("Invalid vault KDF parameter p=%d: it must be between 1 and %d", header.P, maxScryptP)
+	}
+
+	return nil
 }
 
 // Encrypt takes a message and encrypts it with the vault key. Returns a
 // base64 encoded encrypted message.
 func Encrypt(message string, key []byte) string {
+	encrypted, err := encrypt([]byte(message), key, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	return encrypted
+}
+
+// Decrypt takes in an encrypted base64 encoded string and key and returns the decrypted
+func Decrypt(encryptedBase64 string, key []byte) string {
+	decrypted, err := decrypt(encryptedBase64, key, nil)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return string(decrypted)
+}
+
+// encrypt seals message with AES-GCM. additionalData is authenticated but not
+// encrypted, and has to be given again to decrypt.
+func encrypt(message []byte, key []byte, additionalData []byte) (string, error) {
 	nonce := make([]byte, nonceLength)
 	_, err := rand.Read(nonce)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
-	ciphertext := aesgcm.Seal(nil, nonce, []byte(message), nil)
+	ciphertext := aesgcm.Seal(nil, nonce, message, additionalData)
 	out := append(nonce, ciphertext...)
 
-	return base64.StdEncoding.EncodeToString(out)
+	return base64.StdEncoding.EncodeToString(out), nil
 }
 
-// Decrypt takes in an encrypted base64 encoded string and key and returns the decrypted
-func Decrypt(encryptedBase64 string, key []byte) string {
+func decrypt(encryptedBase64 string, key []byte, additionalData []byte) ([]byte, error) {
 	encryptedBase64Bytes := []byte(strings.TrimSpace(encryptedBase64))
 
 	encrypted := make([]byte, base64.StdEncoding.DecodedLen(len(encryptedBase64Bytes)))
 	l, err := base64.StdEncoding.Decode(encrypted, encryptedBase64Bytes)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	encrypted = encrypted[:l]
 
+	if len(encrypted) < nonceLength {
+		return nil, errors.New("Encrypted message is too short")
+	}
+
 	nonce := encrypted[:nonceLength]
 	message := encrypted[nonceLength:]
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
 	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
-	decrypted, err := aesgcm.Open(nil, nonce, message, nil)
+	return aesgcm.Open(nil, nonce, message, additionalData)
+}
+
+// EncryptVault encrypts a vault file's contents with the configured key,
+// prompting for a passphrase when the config is in passphrase mode, or for the
+// recipients in options. A non-empty name is recorded in the header and
+// authenticated along with the contents, so the vault can't be passed off as
+// one with a different name.
+func (config *Config) EncryptVault(message []byte, options VaultOptions) (string, error) {
+	header, key, err := config.newVaultKey(options)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
-	return string(decrypted)
+	var additionalData []byte
+	if options.Name != "" {
+		if header == nil {
+			header = &VaultHeader{}
+		}
+		header.Name = options.Name
+		additionalData = []byte(options.Name)
+	}
+
+	payload, err := encrypt(message, key, additionalData)
+	if err != nil {
+		return "", err
+	}
+
+	return FormatVault(header, payload), nil
+}
+
+// DecryptVault decrypts a vault file's contents, recovering the key the way
+// the vault header describes. When a name is expected the vault has to be
+// bound to it. Unbound vaults are refused too, since any vault encrypted with
+// the same key could otherwise be passed off as this one. An empty name
+// accepts any vault.
+func (config *Config) DecryptVault(data []byte, name string) ([]byte, error) {
+	header, payload, err := ParseVault(data)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := config.vaultKey(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if name != "" && (header == nil || header.Name == "") {
+		return nil, fmt.Errorf("Vault isn't bound to a name, expected %q; re-encrypt it with cftool vault encrypt to bind it", name)
+	}
+
+	var additionalData []byte
+	if header != nil && header.Name != "" {
+		if name != "" && header.Name != name {
+			return nil, fmt.Errorf("Vault is bound to %q, not %q", header.Name, name)
+		}
+		additionalData = []byte(header.Name)
+	}
+
+	decrypted, err := decrypt(payload, key, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt vault: %s", err)
+	}
+
+	return decrypted, nil
+}
+
+// newVaultKey picks the key to encrypt a vault with, along with the header
+// that describes how to get it back.
+func (config *Config) newVaultKey(options VaultOptions) (*VaultHeader, []byte, error) {
+	switch {
+	case len(options.Recipients) > 0:
+		key, err := GenerateKey()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		recipients, err := WrapForRecipients(key, options.Recipients)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return &VaultHeader{Recipients: recipients}, key, nil
+
+	case config.VaultPassphrase:
+		header, err := NewPassphraseHeader()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key, err := config.passphraseKey(header, true)
+		return header, key, err
+
+	case config.VaultKey != nil:
+		return nil, config.VaultKey, nil
+
+	case config.KeyProvider != nil:
+		key, wrapped, err := config.KeyProvider.GenerateDataKey()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return &VaultHeader{KeyProvider: config.KeyProvider.Name(), DataKey: wrapped}, key, nil
+	}
+
+	return nil, nil, errors.New("No vault key available")
+}
+
+// vaultKey recovers the key a vault with the given header was encrypted with.
+func (config *Config) vaultKey(header *VaultHeader) ([]byte, error) {
+	switch {
+	case header.usesVaultKey():
+		if config.VaultKey == nil {
+			return nil, errors.New("No vault key available")
+		}
+		return config.VaultKey, nil
+
+	case header.KDF != "":
+		return config.passphraseKey(header, false)
+
+	case len(header.Recipients) > 0:
+		if config.identity == nil {
+			identity, err := LoadIdentity()
+			if err != nil {
+				return nil, err
+			}
+			config.identity = identity
+		}
+		return config.identity.Unwrap(header.Recipients)
+	}
+
+	provider := config.KeyProvider
+	if provider == nil || provider.Name() != header.KeyProvider {
+		provider = config.newKeyProvider(header.KeyProvider)
+	}
+	if provider == nil {
+		return nil, fmt.Errorf("Unknown vault key provider: %s", header.KeyProvider)
+	}
+
+	key, err := provider.UnwrapDataKey(header.DataKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unwrap vault data key: %s", err)
+	}
+
+	return key, nil
+}
+
+// passphraseKey derives a key from the passphrase for this execution,
+// prompting for it the first time it's needed.
+func (config *Config) passphraseKey(header *VaultHeader, confirm bool) ([]byte, error) {
+	if config.passphrase == nil {
+		passphrase, err := PromptSecret("Vault passphrase: ", confirm)
+		if err != nil {
+			return nil, err
+		}
+		config.passphrase = passphrase
+	}
+
+	return DeriveKey(config.passphrase, header)
 }
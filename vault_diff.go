@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/commondream/yamlast"
+)
+
+const maskedValue = "********"
+
+type vaultEntry struct {
+	Path  string
+	Value string
+}
+
+// vaultEntries flattens a vault into its scalar values, in document order.
+func vaultEntries(node *yamlast.Node) []vaultEntry {
+	var entries []vaultEntry
+	walkVaultPaths(node, nil, func(parts []selectorPart, value *yamlast.Node) {
+		entries = append(entries, vaultEntry{Path: formatSelector(parts), Value: value.Value})
+	})
+
+	return entries
+}
+
+// ReadVaultFile decrypts and parses a vault file for display. The vault's
+// name isn't checked, since the file may be a temporary copy.
+func ReadVaultFile(config *Config, path string) (*yamlast.Node, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := config.DecryptVault(data, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return yamlast.Parse(decrypted)
+}
+
+// DiffVaults compares two decrypted vaults by key path. Added, removed and
+// changed paths are marked with +, - and ~. Values are masked unless
+// showValues is set.
+func DiffVaults(oldVault *yamlast.Node, newVault *yamlast.Node, showValues bool) []string {
+	oldEntries := vaultEntries(oldVault)
+	newEntries := vaultEntries(newVault)
+
+	oldValues := map[string]string{}
+	for _, entry := range oldEntries {
+		oldValues[entry.Path] = entry.Value
+	}
+	newValues := map[string]string{}
+	for _, entry := range newEntries {
+		newValues[entry.Path] = entry.Value
+	}
+
+	var lines []string
+	for _, entry := range oldEntries {
+		if _, ok := newValues[entry.Path]; !ok {
+			lines = append(lines, diffLine("-", entry.Path, entry.Value, showValues))
+		}
+	}
+
+	for _, entry := range newEntries {
+		oldValue, ok := oldValues[entry.Path]
+		if !ok {
+			lines = append(lines, diffLine("+", entry.Path, entry.Value, showValues))
+		} else if oldValue != entry.Value {
+			if showValues {
+				lines = append(lines, fmt.Sprintf("~ %s: %s -> %s", entry.Path, oldValue, entry.Value))
+			} else {
+				lines = append(lines, "~ "+entry.Path)
+			}
+		}
+	}
+
+	return lines
+}
+
+func diffLine(mark string, path string, value string, showValues bool) string {
+	if showValues {
+		return fmt.Sprintf("%s %s: %s", mark, path, value)
+	}
+
+	return mark + " " + path
+}
+
+// TextconvVault renders a decrypted vault as one "path: value" line per value,
+// for git's textconv diff driver. Masked values are replaced by a fingerprint
+// keyed with a key derived from vaultKey, so changes still show up in diffs
+// without revealing the value. Without a key they're masked completely.
+func TextconvVault(vault *yamlast.Node, showValues bool, vaultKey []byte) []string {
+	var fingerprintKey []byte
+	if vaultKey != nil {
+		mac := hmac.New(sha256.New, vaultKey)
+		mac.Write([]byte("cftool vault diff"))
+		fingerprintKey = mac.Sum(nil)
+	}
+
+	var lines []string
+	for _, entry := range vaultEntries(vault) {
+		value := entry.Value
+		if !showValues {
+			value = maskedValue
+			if fingerprintKey != nil {
+				mac := hmac.New(sha256.New, fingerprintKey)
+				mac.Write([]byte(entry.Path + "\x00" + entry.Value))
+				value = "hmac:" + hex.EncodeToString(mac.Sum(nil))[:12]
+			}
+		}
+
+		lines = append(lines, fmt.Sprintf("%s: %s", entry.Path, value))
+	}
+
+	return lines
+}
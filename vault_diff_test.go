@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/commondream/yamlast"
+	"github.com/stvp/assert"
+)
+
+func TestDiffVaults(t *testing.T) {
+	oldVault, err := yamlast.Parse([]byte("Db:\n  User: admin\n  Password: old\nKey: gone\n"))
+	assert.Nil(t, err)
+	newVault, err := yamlast.Parse([]byte("Db:\n  User: admin\n  Password: new\n  Host: db\n"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"- Key", "~ Db.Password", "+ Db.Host"},
+		DiffVaults(oldVault, newVault, false))
+	assert.Equal(t, []string{"- Key: gone", "~ Db.Password: old -> new", "+ Db.Host: db"},
+		DiffVaults(oldVault, newVault, true))
+}
+
+func TestTextconvVault(t *testing.T) {
+	vault, err := yamlast.Parse([]byte("Db:\n  Password: secret\n"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"Db.Password: ********"}, TextconvVault(vault, false, nil))
+	assert.Equal(t, []string{"Db.Password: secret"}, TextconvVault(vault, true, nil))
+
+	key, err := GenerateKey()
+	assert.Nil(t, err)
+	lines := TextconvVault(vault, false, key)
+	assert.Equal(t, 1, len(lines))
+	assert.NotEqual(t, "Db.Password: secret", lines[0])
+	assert.Equal(t, lines, TextconvVault(vault, false, key))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/commondream/yamlast"
+)
+
+// EditVault decrypts the vault at path into a private temporary file, opens
+// it in the user's editor and encrypts the result back into place. The
+// plaintext is overwritten and removed when editing finishes or is
+// interrupted. The vault has to be bound to name, and it's re-encrypted with
+// the same name and recipients. A new vault is bound to name.
+func EditVault(config *Config, path string, name string) error {
+	var plaintext []byte
+	var options VaultOptions
+	encrypted, err := ioutil.ReadFile(path)
+	if err == nil && len(bytes.TrimSpace(encrypted)) > 0 {
+		plaintext, err = config.DecryptVault(encrypted, name)
+		if err != nil {
+			return err
+		}
+
+		header, _, _ := ParseVault(encrypted)
+		options = header.Options()
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if options.Name == "" {
+		options.Name = name
+	}
+
+	tmp, err := ioutil.TempFile(privateTempDir(), "cftool-vault-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer secureRemove(tmpPath)
+
+	stop := removeOnSignal(tmpPath)
+	defer stop()
+
+	_, err = tmp.Write(plaintext)
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	var edited []byte
+	for {
+		err = runEditor(tmpPath)
+		if err != nil {
+			return err
+		}
+
+		edited, err = ioutil.ReadFile(tmpPath)
+		if err != nil {
+			return err
+		}
+
+		_, err = yamlast.Parse(edited)
+		if err == nil {
+			break
+		}
+
+		fmt.Fprintln(os.Stderr, "The edited vault isn't valid YAML:", err.Error())
+		if !confirm("Edit again? [Y/n] ") {
+			return errors.New("Vault left unchanged")
+		}
+	}
+
+	if bytes.Equal(edited, plaintext) {
+		fmt.Fprintln(os.Stderr, "No changes made to", path)
+		return nil
+	}
+
+	out, err := config.EncryptVault(edited, options)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, []byte(out), 0644)
+}
+
+// privateTempDir prefers a memory backed directory so decrypted vaults never
+// touch disk when the system provides one.
+func privateTempDir() string {
+	info, err := os.Stat("/dev/shm")
+	if err == nil && info.IsDir() {
+		return "/dev/shm"
+	}
+
+	return os.TempDir()
+}
+
+// removeOnSignal securely removes path if the process is interrupted or
+// terminated. The returned function stops watching for signals.
+func removeOnSignal(path string) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func() {
+		if _, ok := <-signals; ok {
+			secureRemove(path)
+			os.Exit(-1)
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
+
+// secureRemove overwrites a file with zeros before removing it.
+func secureRemove(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err == nil {
+		file.Write(make([]byte, info.Size()))
+		file.Sync()
+		file.Close()
+	}
+
+	os.Remove(path)
+}
+
+func runEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	// Run through the shell so editors configured with arguments, like
+	// "code --wait", work.
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Error running editor %s: %s", editor, err)
+	}
+
+	return nil
+}
+
+func confirm(prompt string) bool {
+	fmt.Fprint(os.Stderr, prompt)
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "" || answer == "y" || answer == "yes"
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+func TestEditVault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := GenerateKey()
+	assert.Nil(t, err)
+	config := &Config{VaultKey: key}
+
+	path := filepath.Join(dir, "vault")
+	err = ioutil.WriteFile(path, []byte(Encrypt("A: b\n", key)), 0644)
+	assert.Nil(t, err)
+
+	editor := filepath.Join(dir, "editor")
+	err = ioutil.WriteFile(editor, []byte("#!/bin/sh\nprintf 'A: c\\n' > \"$1\"\n"), 0755)
+	assert.Nil(t, err)
+	os.Setenv("VISUAL", editor)
+	defer os.Unsetenv("VISUAL")
+
+	err = EditVault(config, path, "")
+	assert.Nil(t, err)
+
+	encrypted, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	decrypted, err := config.DecryptVault(encrypted, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "A: c\n", string(decrypted))
+}
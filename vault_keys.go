@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/commondream/yamlast"
+)
+
+// GetVaultValue returns the vault node at selector.
+func GetVaultValue(config *Config, selector string) (*yamlast.Node, error) {
+	err := config.LoadVault()
+	if err != nil {
+		return nil, err
+	}
+
+	node := selectNode(config.VaultAST, selector)
+	if node == nil {
+		return nil, fmt.Errorf("Unknown vault value: %s", selector)
+	}
+
+	return node, nil
+}
+
+// SetVaultValue sets the scalar at selector, creating any missing mappings
+// along the way, and saves the vault.
+func SetVaultValue(config *Config, selector string, value string) error {
+	parts, err := parseSelector(selector)
+	if err != nil {
+		return err
+	}
+
+	err = config.LoadVault()
+	if err != nil {
+		return err
+	}
+
+	if config.VaultAST == nil || len(config.VaultAST.Children) == 0 {
+		config.VaultAST = &yamlast.Node{
+			Kind:     yamlast.DocumentNode,
+			Anchors:  map[string]*yamlast.Node{},
+			Children: []*yamlast.Node{{Kind: yamlast.MappingNode}},
+		}
+	}
+
+	current := config.VaultAST.Children[0]
+	for i, part := range parts {
+		last := i == len(parts)-1
+
+		if part.IsIndex {
+			if current.Kind != yamlast.SequenceNode || part.Index >= len(current.Children) {
+				return fmt.Errorf("Unknown vault value: %s", formatSelector(parts[:i+1]))
+			}
+
+			if last {
+				current.Children[part.Index] = &yamlast.Node{Kind: yamlast.ScalarNode, Value: value}
+			} else {
+				current = current.Children[part.Index]
+			}
+			continue
+		}
+
+		if current.Kind != yamlast.MappingNode {
+			return fmt.Errorf("%s is not a mapping", formatSelector(parts[:i]))
+		}
+
+		var child *yamlast.Node
+		for j := 0; j < len(current.Children); j += 2 {
+			if current.Children[j].Value == part.Key {
+				if last {
+					current.Children[j+1] = &yamlast.Node{Kind: yamlast.ScalarNode, Value: value}
+				}
+				child = current.Children[j+1]
+				break
+			}
+		}
+
+		if child == nil {
+			child = &yamlast.Node{Kind: yamlast.MappingNode}
+			if last {
+				child = &yamlast.Node{Kind: yamlast.ScalarNode, Value: value}
+			}
+			current.Children = append(current.Children,
+				&yamlast.Node{Kind: yamlast.ScalarNode, Value: part.Key}, child)
+		}
+		current = child
+	}
+
+	return config.SaveVault()
+}
+
+// UnsetVaultValue removes the value at selector and saves the vault.
+func UnsetVaultValue(config *Config, selector string) error {
+	parts, err := parseSelector(selector)
+	if err != nil {
+		return err
+	}
+
+	_, err = GetVaultValue(config, selector)
+	if err != nil {
+		return err
+	}
+
+	parent := config.VaultAST.Children[0]
+	if len(parts) > 1 {
+		parent = selectNode(config.VaultAST, formatSelector(parts[:len(parts)-1]))
+	}
+
+	last := parts[len(parts)-1]
+	if last.IsIndex {
+		parent.Children = append(parent.Children[:last.Index], parent.Children[last.Index+1:]...)
+	} else {
+		for j := 0; j < len(parent.Children); j += 2 {
+			if parent.Children[j].Value == last.Key {
+				parent.Children = append(parent.Children[:j], parent.Children[j+2:]...)
+				break
+			}
+		}
+	}
+
+	return config.SaveVault()
+}
+
+// VaultPaths lists the selectors of every scalar value in a vault.
+func VaultPaths(node *yamlast.Node) []string {
+	var paths []string
+	walkVaultPaths(node, nil, func(parts []selectorPart, value *yamlast.Node) {
+		paths = append(paths, formatSelector(parts))
+	})
+
+	return paths
+}
+
+func walkVaultPaths(node *yamlast.Node, parts []selectorPart, visit func([]selectorPart, *yamlast.Node)) {
+	if node == nil {
+		return
+	}
+
+	switch node.Kind {
+	case yamlast.DocumentNode:
+		for _, child := range node.Children {
+			walkVaultPaths(child, parts, visit)
+		}
+
+	case yamlast.MappingNode:
+		for i := 0; i < len(node.Children)/2; i++ {
+			path := append(append([]selectorPart{}, parts...), selectorPart{Key: node.Children[i*2].Value})
+			walkVaultPaths(node.Children[i*2+1], path, visit)
+		}
+
+	case yamlast.SequenceNode:
+		for i, child := range node.Children {
+			path := append(append([]selectorPart{}, parts...), selectorPart{Index: i, IsIndex: true})
+			walkVaultPaths(child, path, visit)
+		}
+
+	default:
+		visit(parts, node)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+func TestVaultValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := GenerateKey()
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, "vault")
+	config := &Config{VaultKey: key, VaultPath: path}
+	encrypted, err := config.EncryptVault([]byte("Db:\n  User: admin\nHosts:\n  - a\n  - b\n"),
+		VaultOptions{Name: config.expectedVaultName()})
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path, []byte(encrypted), 0644)
+	assert.Nil(t, err)
+
+	err = SetVaultValue(config, "Db.Password", "p@ss: word")
+	assert.Nil(t, err)
+	err = UnsetVaultValue(config, "Hosts[0]")
+	assert.Nil(t, err)
+
+	config = &Config{VaultKey: key, VaultPath: path}
+	node, err := GetVaultValue(config, "Db.Password")
+	assert.Nil(t, err)
+	assert.Equal(t, "p@ss: word", node.Value)
+
+	_, err = GetVaultValue(config, "Db.Missing")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, []string{"Db.User", "Db.Password", "Hosts[0]"}, VaultPaths(config.VaultAST))
+}
+
+func TestSetVaultValueKeepsUndecryptableVault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cftool-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := GenerateKey()
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, "vault")
+	original := []byte(Encrypt("Db:\n  User: admin\n", key))
+	err = ioutil.WriteFile(path, original, 0600)
+	assert.Nil(t, err)
+
+	// Without the key the vault can't be read, so it must not be replaced.
+	config := &Config{VaultPath: path}
+	err = SetVaultValue(config, "New", "x")
+	assert.NotNil(t, err)
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, original, data)
+
+	// A missing vault file starts a new vault.
+	config = &Config{VaultKey: key, VaultPath: filepath.Join(dir, "new-vault")}
+	err = SetVaultValue(config, "New", "x")
+	assert.Nil(t, err)
+}
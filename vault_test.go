@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stvp/assert"
@@ -16,3 +17,103 @@ func TestEncryptAndDecrypt(t *testing.T) {
 
 	assert.Equal(t, message, decrypted)
 }
+
+func TestPassphraseVault(t *testing.T) {
+	config := &Config{VaultPassphrase: true, passphrase: []byte("correct horse")}
+
+	encrypted, err := config.EncryptVault([]byte("Db:\n  Password: secret\n"), VaultOptions{})
+	assert.Nil(t, err)
+
+	header, _, err := ParseVault([]byte(encrypted))
+	assert.Nil(t, err)
+	assert.NotNil(t, header)
+	assert.Equal(t, "scrypt", header.KDF)
+	assert.Equal(t, saltLength, len(header.Salt))
+
+	decrypted, err := config.DecryptVault([]byte(encrypted), "")
+	assert.Nil(t, err)
+	assert.Equal(t, "Db:\n  Password: secret\n", string(decrypted))
+
+	wrong := &Config{passphrase: []byte("battery staple")}
+	_, err = wrong.DecryptVault([]byte(encrypted), "")
+	assert.NotNil(t, err)
+}
+
+func TestParseVaultWithoutHeader(t *testing.T) {
+	key, err := GenerateKey()
+	assert.Nil(t, err)
+
+	encrypted := Encrypt("THIS IS A TEST", key)
+	header, payload, err := ParseVault([]byte(encrypted + "\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, header)
+	assert.Equal(t, encrypted, payload)
+}
+
+func TestVaultBinaryRoundTrip(t *testing.T) {
+	key, err := GenerateKey()
+	assert.Nil(t, err)
+	config := &Config{VaultKey: key}
+
+	message := []byte{0, 1, 2, 0xff, '\n', '\r', 0x80}
+	encrypted, err := config.EncryptVault(message, VaultOptions{})
+	assert.Nil(t, err)
+
+	decrypted, err := config.DecryptVault([]byte(encrypted+"\n"), "")
+	assert.Nil(t, err)
+	assert.Equal(t, message, decrypted)
+}
+
+func TestVaultBoundToName(t *testing.T) {
+	key, err := GenerateKey()
+	assert.Nil(t, err)
+	config := &Config{VaultKey: key}
+
+	encrypted, err := config.EncryptVault([]byte("Db: prod"), VaultOptions{Name: "prod/vault"})
+	assert.Nil(t, err)
+
+	decrypted, err := config.DecryptVault([]byte(encrypted), "prod/vault")
+	assert.Nil(t, err)
+	assert.Equal(t, "Db: prod", string(decrypted))
+
+	_, err = config.DecryptVault([]byte(encrypted), "dev/vault")
+	assert.NotNil(t, err)
+
+	// A vault that isn't bound could be any vault with the same key.
+	unbound, err := config.EncryptVault([]byte("Db: dev"), VaultOptions{})
+	assert.Nil(t, err)
+	_, err = config.DecryptVault([]byte(unbound), "prod/vault")
+	assert.NotNil(t, err)
+	_, err = config.DecryptVault([]byte(Encrypt("Db: dev", key)), "prod/vault")
+	assert.NotNil(t, err)
+
+	// Rewriting the name in the header breaks authentication.
+	tampered := strings.Replace(encrypted, "Name: prod/vault", "Name: dev/vault", 1)
+	_, err = config.DecryptVault([]byte(tampered), "dev/vault")
+	assert.NotNil(t, err)
+}
+
+func TestLargeVaultWithHeader(t *testing.T) {
+	config := &Config{VaultPassphrase: true, passphrase: []byte("correct horse")}
+
+	message := "Blob: " + strings.Repeat("x", 200*1024) + "\n"
+	encrypted, err := config.EncryptVault([]byte(message), VaultOptions{Name: "vault"})
+	assert.Nil(t, err)
+
+	decrypted, err := config.DecryptVault([]byte(encrypted), "vault")
+	assert.Nil(t, err)
+	assert.Equal(t, message, string(decrypted))
+}
+
+func TestVaultKDFLimits(t *testing.T) {
+	config := &Config{VaultPassphrase: true, passphrase: []byte("correct horse")}
+
+	encrypted, err := config.EncryptVault([]byte("Db: prod"), VaultOptions{Name: "vault"})
+	assert.Nil(t, err)
+
+	for _, params := range []string{"N=1073741824 r=8 p=1", "N=32767 r=8 p=1", "N=0 r=8 p=1", "N=32768 r=64 p=1", "N=32768 r=8 p=17", "N=32768 r=0 p=1"} {
+		tampered := strings.Replace(encrypted, "N=32768 r=8 p=1", params, 1)
+		_, _, err = ParseVault([]byte(tampered))
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/commondream/yamlast"
+)
+
+// FormatYAML writes a node tree back out as YAML. Comments and formatting
+// from the original source aren't preserved, and aliases are expanded.
+func FormatYAML(doc *yamlast.Node) []byte {
+	var out bytes.Buffer
+	anchors := map[string]*yamlast.Node{}
+	if doc.Kind == yamlast.DocumentNode {
+		anchors = doc.Anchors
+	}
+
+	writeYAMLNode(&out, doc, anchors, 0)
+	return out.Bytes()
+}
+
+func writeYAMLNode(out *bytes.Buffer, node *yamlast.Node, anchors map[string]*yamlast.Node, indent int) {
+	prefix := strings.Repeat("  ", indent)
+
+	switch node.Kind {
+	case yamlast.DocumentNode:
+		for _, child := range node.Children {
+			writeYAMLNode(out, child, anchors, indent)
+		}
+
+	case yamlast.MappingNode:
+		if len(node.Children) == 0 {
+			out.WriteString(prefix + "{}\n")
+			return
+		}
+
+		for i := 0; i < len(node.Children)/2; i++ {
+			key := node.Children[i*2]
+			value := resolveAlias(node.Children[i*2+1], anchors)
+
+			out.WriteString(prefix + formatScalar(key.Value) + ":")
+			writeYAMLValue(out, value, anchors, indent)
+		}
+
+	case yamlast.SequenceNode:
+		if len(node.Children) == 0 {
+			out.WriteString(prefix + "[]\n")
+			return
+		}
+
+		for _, child := range node.Children {
+			out.WriteString(prefix + "-")
+			writeYAMLValue(out, resolveAlias(child, anchors), anchors, indent)
+		}
+
+	case yamlast.AliasNode:
+		writeYAMLNode(out, resolveAlias(node, anchors), anchors, indent)
+
+	default:
+		out.WriteString(prefix + formatScalar(node.Value) + "\n")
+	}
+}
+
+// writeYAMLValue writes a node that follows a mapping key or sequence dash.
+func writeYAMLValue(out *bytes.Buffer, node *yamlast.Node, anchors map[string]*yamlast.Node, indent int) {
+	if node.Kind == yamlast.ScalarNode || len(node.Children) == 0 {
+		out.WriteString(" ")
+		writeYAMLNode(out, node, anchors, 0)
+		return
+	}
+
+	out.WriteString("\n")
+	writeYAMLNode(out, node, anchors, indent+1)
+}
+
+func resolveAlias(node *yamlast.Node, anchors map[string]*yamlast.Node) *yamlast.Node {
+	if node.Kind == yamlast.AliasNode {
+		if anchored, ok := anchors[node.Value]; ok {
+			return anchored
+		}
+	}
+
+	return node
+}
+
+// formatScalar returns value as a plain scalar where that's unambiguous and
+// double quoted otherwise.
+func formatScalar(value string) string {
+	if value == "" || value != strings.TrimSpace(value) ||
+		strings.ContainsAny(value[:1], "-?:,[]{}#&*!|>'\"%@`") ||
+		strings.Contains(value, ": ") || strings.Contains(value, " #") ||
+		strings.HasSuffix(value, ":") {
+		return strconv.Quote(value)
+	}
+
+	for _, r := range value {
+		if r != ' ' && !unicode.IsPrint(r) {
+			return strconv.Quote(value)
+		}
+	}
+
+	return value
+}
+
+// copyNode returns a deep copy of a node tree, so it can be inserted
+// somewhere else and processed without changing the original.
+func copyNode(node *yamlast.Node) *yamlast.Node {
+	if node == nil {
+		return nil
+	}
+
+	copied := *node
+	copied.Children = nil
+	for _, child := range node.Children {
+		copied.Children = append(copied.Children, copyNode(child))
+	}
+
+	return &copied
+}
+
+// mergeNodes deep merges overlay onto a copy of base. Mappings are merged key
+// by key; anything else in overlay replaces what's in base.
+func mergeNodes(base *yamlast.Node, overlay *yamlast.Node) *yamlast.Node {
+	if base == nil || base.Kind != yamlast.MappingNode || overlay.Kind != yamlast.MappingNode {
+		return copyNode(overlay)
+	}
+
+	merged := copyNode(base)
+	for i := 0; i < len(overlay.Children)/2; i++ {
+		key := overlay.Children[i*2]
+		value := overlay.Children[i*2+1]
+
+		found := false
+		for j := 0; j < len(merged.Children)/2; j++ {
+			if merged.Children[j*2].Value == key.Value {
+				merged.Children[j*2+1] = mergeNodes(merged.Children[j*2+1], value)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			merged.Children = append(merged.Children, copyNode(key), copyNode(value))
+		}
+	}
+
+	return merged
+}
+
+// parseYAML parses a YAML document. yamlast only records the tags of
+// scalars, so the tags of mappings and sequences, which build tags like
+// !foreach and !when rely on, are read back from the source.
+func parseYAML(source []byte) (*yamlast.Node, error) {
+	doc, err := yamlast.Parse(source)
+	if err != nil || doc == nil {
+		return doc, err
+	}
+
+	lines := strings.Split(strings.TrimPrefix(string(source), "\ufeff"), "\n")
+	restoreCollectionTags(doc, lines)
+
+	return doc, nil
+}
+
+// parseYAMLDocuments parses every document in a YAML stream, restoring their
+// collection tags like parseYAML does. Empty documents, like the one after a
+// trailing ---, are left out.
+func parseYAMLDocuments(source []byte) ([]*yamlast.Node, error) {
+	var docs []*yamlast.Node
+	for _, chunk := range splitYAMLDocuments(source) {
+		doc, err := parseYAML(chunk)
+		if err != nil {
+			return nil, err
+		}
+		if !isEmptyDocument(doc) {
+			docs = append(docs, doc)
+		}
+	}
+
+	return docs, nil
+}
+
+// splitYAMLDocuments splits a YAML stream into one source per document. A
+// line starting with --- or ... is always a document marker, so the stream
+// can be split without parsing it. Directives go with the document they
+// precede, and every document is padded with the lines before it, so
+// positions and errors still refer to lines of the whole stream.
+func splitYAMLDocuments(source []byte) [][]byte {
+	var chunks [][]byte
+	var current []string
+	start := 0
+
+	finish := func(lines []string) {
+		chunks = append(chunks, []byte(strings.Repeat("\n", start)+strings.Join(lines, "")))
+	}
+
+	lines := strings.SplitAfter(string(source), "\n")
+	for i, line := range lines {
+		switch {
+		case isDocumentMarker(line, "---"):
+			directives := leadingDirectives(current)
+			finish(current[:directives])
+			start = i - (len(current) - directives)
+			current = append(current[directives:], line)
+
+		case isDocumentMarker(line, "..."):
+			finish(current)
+			start = i + 1
+			current = nil
+
+		default:
+			current = append(current, line)
+		}
+	}
+	finish(current)
+
+	return chunks
+}
+
+// leadingDirectives returns where the directives at the end of lines, along
+// with any blank or comment lines between them, start. That's len(lines) when
+// there are none.
+func leadingDirectives(lines []string) int {
+	directives := len(lines)
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(lines[i], "%") {
+			directives = i
+		} else if line != "" && !strings.HasPrefix(line, "#") {
+			break
+		}
+	}
+
+	return directives
+}
+
+func isDocumentMarker(line string, marker string) bool {
+	return strings.HasPrefix(line, marker) &&
+		(len(line) == len(marker) || strings.ContainsAny(line[len(marker):len(marker)+1], " \t\r\n"))
+}
+
+// isEmptyDocument is true for a document without content, or with nothing but
+// a null.
+func isEmptyDocument(doc *yamlast.Node) bool {
+	if doc == nil || len(doc.Children) == 0 {
+		return true
+	}
+
+	node := doc.Children[0]
+	if node.Kind != yamlast.ScalarNode || node.Tag != "" || !node.Implicit {
+		return false
+	}
+
+	switch node.Value {
+	case "", "~", "null", "Null", "NULL":
+		return true
+	}
+
+	return false
+}
+
+// restoreCollectionTags sets the tags of the mappings and sequences under
+// node. The parser positions a collection at its tag when it has one, and at
+// its first entry otherwise, so a collection that doesn't start where its
+// first child does starts with its own properties.
+func restoreCollectionTags(node *yamlast.Node, lines []string) {
+	if (node.Kind == yamlast.MappingNode || node.Kind == yamlast.SequenceNode) && node.Tag == "" {
+		first := len(node.Children) > 0 &&
+			node.Children[0].Line == node.Line && node.Children[0].Column == node.Column
+		if !first {
+			node.Tag = tagAt(lines, node.Line, node.Column)
+		}
+	}
+
+	for _, child := range node.Children {
+		restoreCollectionTags(child, lines)
+	}
+}
+
+// tagAt returns the tag among the node properties, an anchor and a tag in
+// either order, that start at line and column. Tags are resolved the way the
+// parser resolves scalar tags.
+func tagAt(lines []string, line int, column int) string {
+	if line >= len(lines) {
+		return ""
+	}
+
+	text := []rune(strings.TrimRight(lines[line], "\r"))
+	if column >= len(text) {
+		return ""
+	}
+
+	rest := string(text[column:])
+	for i := 0; i < 2; i++ {
+		if strings.HasPrefix(rest, "!<") {
+			end := strings.Index(rest, ">")
+			if end < 0 {
+				return ""
+			}
+			return rest[2:end]
+		}
+
+		end := strings.IndexAny(rest, " \t,[]{}")
+		if end < 0 {
+			end = len(rest)
+		}
+		property := rest[:end]
+
+		switch {
+		case strings.HasPrefix(property, "&"):
+			rest = strings.TrimLeft(rest[end:], " \t")
+		case strings.HasPrefix(property, "!!"):
+			return "tag:yaml.org,2002:" + property[2:]
+		case strings.HasPrefix(property, "!"):
+			return property
+		default:
+			return ""
+		}
+	}
+
+	return ""
+}
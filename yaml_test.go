@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+func TestCollectionTags(t *testing.T) {
+	doc, err := parseYAML([]byte(`---
+Loop: !foreach
+  Items: [a, b]
+  Body: {}
+Flow: !when {Condition: yes, Then: 1}
+Anchored: &shared !if-env
+  Environment: prod
+  Then: 1
+List: !list
+  - a
+Verbatim: !<tag:example.com,2016:x> [a]
+Untagged:
+  a: b
+KeyTag:
+  !ref Key: value
+Items:
+  - !ref a
+  - !item
+    Name: b
+`))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "!foreach", selectNode(doc, "Loop").Tag)
+	assert.Equal(t, "", selectNode(doc, "Loop.Items").Tag)
+	assert.Equal(t, "!when", selectNode(doc, "Flow").Tag)
+	assert.Equal(t, "!if-env", selectNode(doc, "Anchored").Tag)
+	assert.Equal(t, "!list", selectNode(doc, "List").Tag)
+	assert.Equal(t, "tag:example.com,2016:x", selectNode(doc, "Verbatim").Tag)
+	assert.Equal(t, "", selectNode(doc, "Untagged").Tag)
+	assert.Equal(t, "", selectNode(doc, "KeyTag").Tag)
+	assert.Equal(t, "", selectNode(doc, "Items").Tag)
+	assert.Equal(t, "!ref", selectNode(doc, "Items[0]").Tag)
+	assert.Equal(t, "!item", selectNode(doc, "Items[1]").Tag)
+	assert.Equal(t, "", doc.Children[0].Tag)
+}
+
+func TestFormatScalarRoundTrip(t *testing.T) {
+	values := []string{"é\u2028x", "a\u2029b", "a\u0085b", "\ufeffa", "a\ufeff", "tab\there", "del\x7f", "plain é"}
+	for _, value := range values {
+		doc, err := parseYAML([]byte("Db:\n  X: placeholder\n"))
+		assert.Nil(t, err)
+		selectNode(doc, "Db.X").Value = value
+
+		parsed, err := parseYAML(FormatYAML(doc))
+		assert.Nil(t, err)
+		assert.Equal(t, value, selectNode(parsed, "Db.X").Value)
+	}
+}